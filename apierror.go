@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum size of a request body in bytes
+var maxRequestBodyBytes int64 = 1 << 20
+
+// APIError is the body of error responses, wrapped in an "error" field
+type APIError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Aborts the request with the status and a JSON error body
+func abortWithError(c *gin.Context, status int, code string, message string) {
+	c.AbortWithStatusJSON(status, gin.H{"error": APIError{Code: code, Message: message}})
+}
+
+// Strictly decodes a JSON request body, rejecting unknown fields and bodies over the size limit
+func decodeJSONBody(c *gin.Context, v any) error {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxRequestBodyBytes)
+
+	decoder := json.NewDecoder(c.Request.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return err
+	}
+	if decoder.More() {
+		return errors.New("request body must contain a single JSON object")
+	}
+	return nil
+}
+
+// Aborts the request with an error describing why the body could not be decoded
+func abortWithDecodeError(c *gin.Context, err error) {
+	var maxBytesErr *http.MaxBytesError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	var statusErr *UnknownStatusError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		abortWithError(c, http.StatusRequestEntityTooLarge, "body_too_large", fmt.Sprintf("request body must not be larger than %d bytes", maxBytesErr.Limit))
+	case errors.As(err, &syntaxErr):
+		abortWithError(c, http.StatusBadRequest, "invalid_json", fmt.Sprintf("request body contains malformed JSON at position %d", syntaxErr.Offset))
+	case errors.As(err, &statusErr):
+		abortWithError(c, http.StatusBadRequest, "invalid_field", fmt.Sprintf("field \"status\" must be a status number or name, got %s", statusErr.Value))
+	case errors.As(err, &typeErr):
+		abortWithError(c, http.StatusBadRequest, "invalid_field", fmt.Sprintf("field %q must be of type %s", typeErr.Field, typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		field := strings.TrimPrefix(err.Error(), "json: unknown field ")
+		abortWithError(c, http.StatusBadRequest, "unknown_field", fmt.Sprintf("request body contains unknown field %s", field))
+	case errors.Is(err, io.EOF):
+		abortWithError(c, http.StatusBadRequest, "invalid_json", "request body must not be empty")
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		abortWithError(c, http.StatusBadRequest, "invalid_json", "request body contains malformed JSON")
+	default:
+		abortWithError(c, http.StatusBadRequest, "invalid_json", err.Error())
+	}
+}
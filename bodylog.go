@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Placeholder logged instead of the value of a sensitive field
+const redactedValue = "[REDACTED]"
+
+// Fields whose values are never logged, matched case-insensitively against any part of a field name
+var sensitiveFields = []string{"customerid", "externalref", "password", "secret", "token", "apikey"}
+
+// BodyLoggingMiddleware logs request and response bodies up to maxBytes each, redacting sensitive fields.
+// The request body is put back after it is read, so handlers still see all of it.
+func BodyLoggingMiddleware(maxBytes int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestId := c.GetString("requestId")
+
+		if c.Request.Body != nil {
+			body := c.Request.Body
+			head, err := io.ReadAll(io.LimitReader(body, int64(maxBytes)+1))
+			if err != nil {
+				log.Printf("Failed to read request body of %s for logging: %s", requestId, err)
+			}
+			c.Request.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(head), body), body}
+
+			log.Printf("Request body of %s %s %s: %s", requestId, c.Request.Method, c.Request.URL.Path, formatLoggedBody(head, maxBytes))
+		}
+
+		writer := &bodyLoggingWriter{ResponseWriter: c.Writer, maxBytes: maxBytes}
+		c.Writer = writer
+		c.Next()
+
+		log.Printf("Response body of %s with status %d: %s", requestId, writer.Status(), formatLoggedBody(writer.body.Bytes(), maxBytes))
+	}
+}
+
+// Renders a body for the log. Bodies that aren't complete JSON are summarized rather than logged,
+// because sensitive fields can't be found and redacted in them.
+func formatLoggedBody(body []byte, maxBytes int) string {
+	if len(body) == 0 {
+		return "<empty>"
+	}
+	if len(body) > maxBytes {
+		return fmt.Sprintf("<more than %d bytes, not logged>", maxBytes)
+	}
+
+	var value any
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Sprintf("<%d bytes that aren't JSON, not logged>", len(body))
+	}
+
+	redacted, err := json.Marshal(redactFields(value))
+	if err != nil {
+		return fmt.Sprintf("<%d bytes that couldn't be redacted, not logged>", len(body))
+	}
+	return string(redacted)
+}
+
+// Replaces the values of sensitive fields anywhere in a decoded JSON value
+func redactFields(value any) any {
+	switch v := value.(type) {
+	case map[string]any:
+		for key, field := range v {
+			if isSensitiveField(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactFields(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = redactFields(item)
+		}
+	}
+	return value
+}
+
+func isSensitiveField(name string) bool {
+	name = strings.ToLower(name)
+	for _, field := range sensitiveFields {
+		if strings.Contains(name, field) {
+			return true
+		}
+	}
+	return false
+}
+
+// bodyLoggingWriter keeps a copy of the first bytes of the response body, plus one to tell when it was cut short
+type bodyLoggingWriter struct {
+	gin.ResponseWriter
+	maxBytes int
+	body     bytes.Buffer
+}
+
+func (w *bodyLoggingWriter) Write(data []byte) (int, error) {
+	w.capture(data)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *bodyLoggingWriter) WriteString(s string) (int, error) {
+	w.capture([]byte(s))
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *bodyLoggingWriter) capture(data []byte) {
+	if remaining := w.maxBytes + 1 - w.body.Len(); remaining > 0 {
+		w.body.Write(data[:min(len(data), remaining)])
+	}
+}
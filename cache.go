@@ -0,0 +1,256 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"hash/fnv"
+	"sync"
+	"time"
+)
+
+// Number of lock stripes used to serialize reads and writes of the same order
+const cacheLockStripes = 64
+
+type cacheEntry struct {
+	id    string
+	order Order
+}
+
+// CachedOrderRepo is a size-bounded LRU write-through cache in front of another order repo.
+// Writes go to the underlying repo first and then update the cache, so a read that follows
+// a write always reflects it.
+type CachedOrderRepo struct {
+	repo    OrderRepo
+	size    int
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	stripes [cacheLockStripes]sync.Mutex
+}
+
+func NewCachedOrderRepo(repo OrderRepo, size int) *CachedOrderRepo {
+	return &CachedOrderRepo{
+		repo:    repo,
+		size:    size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func (r *CachedOrderRepo) GetPendingOrders(opts PendingOrdersOptions) ([]Order, error) {
+	return r.repo.GetPendingOrders(opts)
+}
+
+func (r *CachedOrderRepo) GetOrder(id string) (Order, error) {
+	if order, ok := r.get(id); ok {
+		return order, nil
+	}
+
+	// Hold the stripe lock so a concurrent update can't be overwritten by the stale value read here
+	stripe := r.stripe(id)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	if order, ok := r.get(id); ok {
+		return order, nil
+	}
+
+	order, err := r.repo.GetOrder(id)
+	if err != nil {
+		return order, err
+	}
+	r.put(order)
+	return order, nil
+}
+
+// GetOrderForUpdate skips the cache, which may have been filled from a stale read, and refreshes it with
+// the order
+func (r *CachedOrderRepo) GetOrderForUpdate(id string) (Order, error) {
+	stripe := r.stripe(id)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	order, err := r.repo.GetOrderForUpdate(id)
+	if err != nil {
+		return order, err
+	}
+	r.put(order)
+	return order, nil
+}
+
+// Gets an order for a request, timing the cache lookup as the cache phase of the Server-Timing header and
+// reading the order from the database on a miss as the db phase
+func getOrderTimed(ctx context.Context, repo OrderRepo, id string) (Order, error) {
+	if cache, ok := repo.(*CachedOrderRepo); ok {
+		stopTiming := timePhase(ctx, "cache")
+		order, hit := cache.get(id)
+		stopTiming()
+		if hit {
+			return order, nil
+		}
+	}
+
+	stopTiming := timePhase(ctx, "db")
+	defer stopTiming()
+	return repo.GetOrder(id)
+}
+
+// Gets an order an update depends on from the primary, timing it as the db phase of the Server-Timing header
+func getOrderForUpdateTimed(ctx context.Context, repo OrderRepo, id string) (Order, error) {
+	stopTiming := timePhase(ctx, "db")
+	defer stopTiming()
+	return repo.GetOrderForUpdate(id)
+}
+
+func (r *CachedOrderRepo) InsertOrders(orders []Order) error {
+	err := r.repo.InsertOrders(orders)
+	if err != nil {
+		return err
+	}
+	for _, order := range orders {
+		r.put(order)
+	}
+	return nil
+}
+
+func (r *CachedOrderRepo) UpdateOrder(order Order) error {
+	stripe := r.stripe(order.OrderID)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	// Decide the update time here so the cached copy matches the stored one
+	if order.UpdatedAt.IsZero() {
+		order.UpdatedAt = time.Now().UTC()
+	}
+
+	err := r.repo.UpdateOrder(order)
+	if err != nil {
+		// The write may have partially applied, so don't trust the cached copy anymore
+		r.remove(order.OrderID)
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if elem, ok := r.entries[order.OrderID]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.order.Status = order.Status
+		entry.order.UpdatedAt = order.UpdatedAt
+		entry.order.History = append(entry.order.History, StatusChange{Status: order.Status, At: order.UpdatedAt, Actor: order.LastModifiedBy})
+		if order.ExternalRef != "" {
+			entry.order.ExternalRef = order.ExternalRef
+		}
+		entry.order.LastModifiedBy = order.LastModifiedBy
+		r.lru.MoveToFront(elem)
+	}
+	return nil
+}
+
+func (r *CachedOrderRepo) TransitionOrder(id string, from []Status, change StatusChange) (Order, error) {
+	stripe := r.stripe(id)
+	stripe.Lock()
+	defer stripe.Unlock()
+
+	order, err := r.repo.TransitionOrder(id, from, change)
+	if err != nil {
+		r.remove(id)
+		return order, err
+	}
+	r.put(order)
+	return order, nil
+}
+
+func (r *CachedOrderRepo) CountByStatus() (map[Status]int, error) {
+	return r.repo.CountByStatus()
+}
+
+func (r *CachedOrderRepo) ArchiveCompletedOrders(olderThan time.Duration) (int, error) {
+	return r.repo.ArchiveCompletedOrders(olderThan)
+}
+
+// RecoverStuckOrders drops every cached Processing order, since any of them may have been recovered
+func (r *CachedOrderRepo) RecoverStuckOrders(stuckFor time.Duration, change StatusChange) (int, error) {
+	recovered, err := r.repo.RecoverStuckOrders(stuckFor, change)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, elem := range r.entries {
+		if elem.Value.(*cacheEntry).order.Status == Processing {
+			r.lru.Remove(elem)
+			delete(r.entries, id)
+		}
+	}
+
+	return recovered, err
+}
+
+func (r *CachedOrderRepo) Ping(ctx context.Context) error {
+	return r.repo.Ping(ctx)
+}
+
+func (r *CachedOrderRepo) EnsureIndexes(ctx context.Context) error {
+	return r.repo.EnsureIndexes(ctx)
+}
+
+func (r *CachedOrderRepo) GetOrdersByLastModifiedBy(actor string, page Page) ([]Order, error) {
+	return r.repo.GetOrdersByLastModifiedBy(actor, page)
+}
+
+func (r *CachedOrderRepo) SearchOrders(search OrderSearch, page Page) ([]Order, error) {
+	return r.repo.SearchOrders(search, page)
+}
+
+func (r *CachedOrderRepo) stripe(id string) *sync.Mutex {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+	return &r.stripes[h.Sum32()%cacheLockStripes]
+}
+
+func (r *CachedOrderRepo) get(id string) (Order, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	elem, ok := r.entries[id]
+	if !ok {
+		return Order{}, false
+	}
+	r.lru.MoveToFront(elem)
+	return cloneOrder(elem.Value.(*cacheEntry).order), true
+}
+
+func (r *CachedOrderRepo) put(order Order) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if elem, ok := r.entries[order.OrderID]; ok {
+		elem.Value.(*cacheEntry).order = cloneOrder(order)
+		r.lru.MoveToFront(elem)
+		return
+	}
+
+	r.entries[order.OrderID] = r.lru.PushFront(&cacheEntry{order.OrderID, cloneOrder(order)})
+
+	// Evict the least recently used orders once the cache is full
+	for r.lru.Len() > r.size {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.entries, oldest.Value.(*cacheEntry).id)
+	}
+}
+
+func (r *CachedOrderRepo) remove(id string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if elem, ok := r.entries[id]; ok {
+		r.lru.Remove(elem)
+		delete(r.entries, id)
+	}
+}
+
+// Copies the items and history slices so callers can't modify a cached order in place
+func cloneOrder(order Order) Order {
+	order.Items = append([]Item(nil), order.Items...)
+	order.History = append([]StatusChange(nil), order.History...)
+	return order
+}
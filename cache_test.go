@@ -0,0 +1,216 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// countingRepo counts the reads that reach the underlying repo and can be made to fail updates
+type countingRepo struct {
+	*InMemoryOrderRepo
+	gets      int
+	updateErr error
+}
+
+func (r *countingRepo) GetOrder(id string) (Order, error) {
+	r.gets++
+	return r.InMemoryOrderRepo.GetOrder(id)
+}
+
+func (r *countingRepo) UpdateOrder(order Order) error {
+	if r.updateErr != nil {
+		return r.updateErr
+	}
+	return r.InMemoryOrderRepo.UpdateOrder(order)
+}
+
+func newCachedTestRepo(t *testing.T, size int, ids ...string) (*CachedOrderRepo, *countingRepo) {
+	t.Helper()
+	repo := &countingRepo{InMemoryOrderRepo: NewInMemoryOrderRepo()}
+	var orders []Order
+	for _, id := range ids {
+		orders = append(orders, Order{OrderID: id, Status: Pending, Items: []Item{{Product: 1, Quantity: 1, Price: 1}}})
+	}
+	if err := repo.InMemoryOrderRepo.InsertOrders(orders); err != nil {
+		t.Fatal(err)
+	}
+	return NewCachedOrderRepo(repo, size), repo
+}
+
+func TestCachedOrderRepoWriteThrough(t *testing.T) {
+	tests := []struct {
+		name      string
+		updateErr error
+		// status read back through the cache after the update
+		wantStatus Status
+		// reads that reach the underlying repo, including the one that fills the cache
+		wantGets int
+	}{
+		{name: "update refreshes the cached order", wantStatus: Processing, wantGets: 1},
+		{name: "failed update evicts the cached order", updateErr: errors.New("write failed"), wantStatus: Pending, wantGets: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, repo := newCachedTestRepo(t, 10, "1")
+			if _, err := cache.GetOrder("1"); err != nil {
+				t.Fatal(err)
+			}
+
+			repo.updateErr = tt.updateErr
+			err := cache.UpdateOrder(Order{OrderID: "1", Status: Processing, LastModifiedBy: "kitchen"})
+			if !errors.Is(err, tt.updateErr) {
+				t.Fatalf("got error %v, want %v", err, tt.updateErr)
+			}
+
+			order, err := cache.GetOrder("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != tt.wantStatus {
+				t.Errorf("got status %s, want %s", order.Status, tt.wantStatus)
+			}
+			if repo.gets != tt.wantGets {
+				t.Errorf("got %d reads from the repo, want %d", repo.gets, tt.wantGets)
+			}
+
+			stored, err := repo.InMemoryOrderRepo.GetOrder("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != stored.Status || !order.UpdatedAt.Equal(stored.UpdatedAt) || len(order.History) != len(stored.History) {
+				t.Errorf("cached order %+v doesn't match stored order %+v", order, stored)
+			}
+		})
+	}
+}
+
+func TestCachedOrderRepoTransition(t *testing.T) {
+	tests := []struct {
+		name       string
+		from       []Status
+		wantErr    error
+		wantStatus Status
+	}{
+		{name: "transition refreshes the cached order", from: []Status{Pending}, wantStatus: Complete},
+		{name: "failed transition leaves the order unchanged", from: []Status{Processing}, wantErr: ErrPreconditionFailed, wantStatus: Pending},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, _ := newCachedTestRepo(t, 10, "1")
+			if _, err := cache.GetOrder("1"); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := cache.TransitionOrder("1", tt.from, StatusChange{Status: Complete})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+
+			order, err := cache.GetOrder("1")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.Status != tt.wantStatus {
+				t.Errorf("got status %s, want %s", order.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestCachedOrderRepoEvictsLeastRecentlyUsed(t *testing.T) {
+	cache, repo := newCachedTestRepo(t, 2, "1", "2", "3")
+	for _, id := range []string{"1", "2", "1", "3"} {
+		if _, err := cache.GetOrder(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2 was the least recently used when 3 was cached, so only it has to be read again
+	tests := []struct {
+		id       string
+		wantGets int
+	}{
+		{"1", 3},
+		{"3", 3},
+		{"2", 4},
+	}
+	for _, tt := range tests {
+		if _, err := cache.GetOrder(tt.id); err != nil {
+			t.Fatal(err)
+		}
+		if repo.gets != tt.wantGets {
+			t.Errorf("after reading %s got %d reads from the repo, want %d", tt.id, repo.gets, tt.wantGets)
+		}
+	}
+}
+
+func TestCachedOrderRepoReturnsCopies(t *testing.T) {
+	cache, _ := newCachedTestRepo(t, 10, "1")
+	order, err := cache.GetOrder("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	order.Items[0].Quantity = 99
+
+	order, err = cache.GetOrder("1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if order.Items[0].Quantity != 1 {
+		t.Errorf("changing a returned order changed the cached copy")
+	}
+}
+
+func TestGetOrderTimed(t *testing.T) {
+	tests := []struct {
+		name       string
+		cached     bool
+		warm       bool
+		wantPhases []string
+	}{
+		{name: "without a cache", wantPhases: []string{"db"}},
+		{name: "cache miss", cached: true, wantPhases: []string{"cache", "db"}},
+		{name: "cache hit", cached: true, warm: true, wantPhases: []string{"cache"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache, backend := newCachedTestRepo(t, 10, "1")
+			var repo OrderRepo = backend
+			if tt.cached {
+				repo = cache
+			}
+			if tt.warm {
+				cache.GetOrder("1")
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(ServerTimingMiddleware(), OrderMiddleware(NewOrderService(repo)))
+			router.GET("/order/:id", getOrder)
+
+			w := serveJSON(router, http.MethodGet, "/order/1", nil)
+			if w.Code != http.StatusOK {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusOK)
+			}
+
+			var phases []string
+			for _, metric := range strings.Split(w.Header().Get("Server-Timing"), ", ") {
+				name, _, _ := strings.Cut(metric, ";")
+				if name != "total" && name != "serialization" {
+					phases = append(phases, name)
+				}
+			}
+			if !slices.Equal(phases, tt.wantPhases) {
+				t.Errorf("got phases %v in %q, want %v", phases, w.Header().Get("Server-Timing"), tt.wantPhases)
+			}
+		})
+	}
+}
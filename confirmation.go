@@ -0,0 +1,64 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+)
+
+// Order total at or above which completing an order needs to be confirmed. Zero disables confirmation.
+var confirmationThreshold float64
+
+// ErrConfirmationRequired is returned when an order awaiting confirmation is completed without confirming it
+var ErrConfirmationRequired = errors.New("order is awaiting confirmation")
+
+// InvalidTransitionError is returned when an order can't move from its current status to the requested one
+type InvalidTransitionError struct {
+	From Status
+	To   Status
+}
+
+func (e *InvalidTransitionError) Error() string {
+	return fmt.Sprintf("order can't move from %s to %s", e.From, e.To)
+}
+
+// Checks an update is a valid transition from the existing order. Completing an order that needs to
+// be confirmed moves it to PendingCompletion instead, and it can then only be completed by confirming it.
+func applyTransition(existing Order, order *Order) error {
+	if existing.Status == PendingCompletion && order.Status == Complete {
+		return ErrConfirmationRequired
+	}
+	if !existing.Status.CanTransitionTo(order.Status) {
+		return &InvalidTransitionError{existing.Status, order.Status}
+	}
+	if order.Status == Complete && existing.Status != Complete && requiresConfirmation(existing) {
+		order.Status = PendingCompletion
+	}
+	return nil
+}
+
+// Returns the statuses an order can be in to move to the to status, limited to the expected status if
+// one is given. Orders awaiting confirmation can only be completed by confirming them.
+func transitionSources(to Status, expected *Status) []Status {
+	var from []Status
+	for _, status := range Statuses {
+		if !status.CanTransitionTo(to) || (status == PendingCompletion && to == Complete) {
+			continue
+		}
+		if expected != nil && *expected != status {
+			continue
+		}
+		from = append(from, status)
+	}
+	return from
+}
+
+// Returns the statuses an order can be completed from without already being complete, so a conditional
+// completion only succeeds once
+func completionSources() []Status {
+	return slices.DeleteFunc(transitionSources(Complete, nil), func(status Status) bool { return status == Complete })
+}
+
+func requiresConfirmation(order Order) bool {
+	return confirmationThreshold > 0 && order.ComputeTotal() >= confirmationThreshold
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// Backoff is a delay that doubles each time it is used, up to a maximum, until it is reset
+type Backoff struct {
+	initial time.Duration
+	max     time.Duration
+	current time.Duration
+}
+
+func NewBackoff(initial time.Duration, max time.Duration) *Backoff {
+	return &Backoff{initial: initial, max: max, current: initial}
+}
+
+// Next returns the delay to wait and grows the delay for the next call
+func (b *Backoff) Next() time.Duration {
+	delay := b.current
+	b.current *= 2
+	if b.current > b.max {
+		b.current = b.max
+	}
+	return delay
+}
+
+func (b *Backoff) Reset() {
+	b.current = b.initial
+}
+
+// How long to wait for the database to respond before treating it as unhealthy
+const readinessTimeout = 5 * time.Second
+
+// OrderConsumer drains the order queue into the database in the background, backing off while the queue
+// is empty. Consumption pauses while the database is unhealthy so orders aren't pulled that can't be saved.
+// With a lease, only the instance holding it drains the queue and the others wait on standby.
+type OrderConsumer struct {
+	service      *OrderService
+	receive      func() (*OrderBatch, error)
+	readiness    *QueueReadiness
+	lease        *Lease
+	idleInterval time.Duration
+	backoff      *Backoff
+	paused       bool
+}
+
+func NewOrderConsumer(service *OrderService, receive func() (*OrderBatch, error), readiness *QueueReadiness, lease *Lease, idleInterval time.Duration, maxBackoff time.Duration) *OrderConsumer {
+	return &OrderConsumer{
+		service:      service,
+		receive:      receive,
+		readiness:    readiness,
+		lease:        lease,
+		idleInterval: idleInterval,
+		backoff:      NewBackoff(idleInterval, maxBackoff),
+	}
+}
+
+// Run polls the queue until the context is cancelled
+func (c *OrderConsumer) Run(ctx context.Context) {
+	log.Printf("Starting background order consumer")
+	for {
+		delay := c.poll(ctx)
+
+		select {
+		case <-ctx.Done():
+			log.Printf("Stopping background order consumer")
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// Receives and saves one batch of orders, returning how long to wait before polling again
+func (c *OrderConsumer) poll(ctx context.Context) time.Duration {
+	if c.lease != nil && !c.lease.Held() {
+		c.readiness.RecordStandby()
+		return c.idleInterval
+	}
+
+	pingCtx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	err := c.service.repo.Ping(pingCtx)
+	cancel()
+	if err != nil {
+		if !c.paused {
+			log.Printf("Pausing background order consumer, database is unhealthy: %s", err)
+			c.paused = true
+		}
+		return c.backoff.Next()
+	}
+	if c.paused {
+		log.Printf("Resuming background order consumer, database has recovered")
+		c.paused = false
+		c.backoff.Reset()
+	}
+
+	batch, err := c.receive()
+	if err != nil && !errors.Is(err, ErrNoMessages) {
+		log.Printf("Failed to fetch orders from queue: %s", err)
+		c.readiness.RecordFailure()
+		return c.backoff.Next()
+	}
+	c.readiness.RecordSuccess()
+	if err != nil {
+		return c.backoff.Next()
+	}
+
+	_, err = saveNewOrders(c.service, batch.Orders)
+	if err != nil {
+		log.Printf("Failed to save orders to database: %s", err)
+		// Leave the orders on the queue to be received again
+		batch.Abandon()
+		return c.backoff.Next()
+	}
+	batch.Complete()
+
+	// There may be more orders waiting, so poll again straight away
+	c.backoff.Reset()
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	backoff := NewBackoff(time.Second, 5*time.Second)
+
+	var got []time.Duration
+	for i := 0; i < 5; i++ {
+		got = append(got, backoff.Next())
+	}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	if !slices.Equal(got, want) {
+		t.Errorf("got delays %v, want %v", got, want)
+	}
+
+	backoff.Reset()
+	if delay := backoff.Next(); delay != time.Second {
+		t.Errorf("got %s after reset, want %s", delay, time.Second)
+	}
+}
+
+// consumerTestRepo can be made unhealthy or fail inserts
+type consumerTestRepo struct {
+	*InMemoryOrderRepo
+	pingErr   error
+	insertErr error
+}
+
+func (r *consumerTestRepo) Ping(ctx context.Context) error {
+	return r.pingErr
+}
+
+func (r *consumerTestRepo) InsertOrders(orders []Order) error {
+	if r.insertErr != nil {
+		return r.insertErr
+	}
+	return r.InMemoryOrderRepo.InsertOrders(orders)
+}
+
+// testReceive is what one receive from the queue returns
+type testReceive struct {
+	orders []Order
+	err    error
+}
+
+func TestOrderConsumerPoll(t *testing.T) {
+	batch := testReceive{orders: []Order{{OrderID: "1", Items: []Item{{Product: 1, Quantity: 1, Price: 1}}}}}
+	empty := testReceive{err: ErrNoMessages}
+	failed := testReceive{err: errors.New("queue unreachable")}
+
+	tests := []struct {
+		name      string
+		pingErr   error
+		insertErr error
+		// standby polls with a lease that this instance doesn't hold
+		standby  bool
+		receives []testReceive
+		// delay returned by each poll
+		wantDelays []time.Duration
+		// how each received batch was settled, true for completed
+		wantSettled []bool
+		wantStored  int
+		wantReady   bool
+	}{
+		{
+			name:        "saves a batch and polls again straight away",
+			receives:    []testReceive{batch},
+			wantDelays:  []time.Duration{0},
+			wantSettled: []bool{true},
+			wantStored:  1,
+			wantReady:   true,
+		},
+		{
+			name:       "backs off while the queue is empty",
+			receives:   []testReceive{empty, empty, empty, empty},
+			wantDelays: []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 4 * time.Second},
+			wantReady:  true,
+		},
+		{
+			name:        "resets the backoff once orders arrive",
+			receives:    []testReceive{empty, empty, batch, empty},
+			wantDelays:  []time.Duration{time.Second, 2 * time.Second, 0, time.Second},
+			wantSettled: []bool{true},
+			wantStored:  1,
+			wantReady:   true,
+		},
+		{
+			name:       "backs off while the queue can't be reached",
+			receives:   []testReceive{failed, failed},
+			wantDelays: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:        "abandons a batch that can't be saved",
+			insertErr:   errors.New("insert failed"),
+			receives:    []testReceive{batch},
+			wantDelays:  []time.Duration{time.Second},
+			wantSettled: []bool{false},
+			wantReady:   true,
+		},
+		{
+			name:       "pauses without receiving while the database is unhealthy",
+			pingErr:    errors.New("database down"),
+			receives:   []testReceive{batch, batch},
+			wantDelays: []time.Duration{time.Second, 2 * time.Second},
+		},
+		{
+			name:       "waits on standby without the lease",
+			standby:    true,
+			receives:   []testReceive{batch, batch},
+			wantDelays: []time.Duration{time.Second, time.Second},
+			wantReady:  true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &consumerTestRepo{InMemoryOrderRepo: NewInMemoryOrderRepo(), pingErr: tt.pingErr, insertErr: tt.insertErr}
+			readiness := NewQueueReadiness(time.Minute, newFakeClock())
+
+			var settled []bool
+			received := 0
+			receive := func() (*OrderBatch, error) {
+				r := tt.receives[received]
+				received++
+				if r.err != nil {
+					return nil, r.err
+				}
+				return &OrderBatch{Orders: slices.Clone(r.orders), settle: func(saved bool) { settled = append(settled, saved) }}, nil
+			}
+
+			var lease *Lease
+			if tt.standby {
+				// the lease is never renewed, so it is never held
+				lease = NewLease(nil, consumerLeaseName, "holder", time.Minute, time.Second, newFakeClock())
+			}
+
+			consumer := NewOrderConsumer(NewOrderService(repo), receive, readiness, lease, time.Second, 4*time.Second)
+			var delays []time.Duration
+			for range tt.wantDelays {
+				delays = append(delays, consumer.poll(context.Background()))
+			}
+
+			if !slices.Equal(delays, tt.wantDelays) {
+				t.Errorf("got delays %v, want %v", delays, tt.wantDelays)
+			}
+			if !slices.Equal(settled, tt.wantSettled) {
+				t.Errorf("got batches settled %v, want %v", settled, tt.wantSettled)
+			}
+			pending, _ := repo.GetPendingOrders(PendingOrdersOptions{})
+			if len(pending) != tt.wantStored {
+				t.Errorf("got %d stored orders, want %d", len(pending), tt.wantStored)
+			}
+			if ready, _ := readiness.Ready(); ready != tt.wantReady {
+				t.Errorf("got ready %v, want %v", ready, tt.wantReady)
+			}
+		})
+	}
+}
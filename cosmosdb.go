@@ -3,25 +3,54 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
+	"net/http"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/data/azcosmos"
 	"github.com/gofrs/uuid"
 )
 
+// Most operations Cosmos DB allows in one transactional batch
+const cosmosMaxBatchOperations = 100
+
+// PartitionKey is the property orders are partitioned by. When Value is set every order is stored in that
+// partition, otherwise each order is stored in the partition of its StoreID and queries span all partitions.
 type PartitionKey struct {
 	Key   string
 	Value string
 }
 
+// CosmosDBOrderRepo stores orders in a container. Read-only queries use readConsistency if it is set.
 type CosmosDBOrderRepo struct {
-	db           *azcosmos.ContainerClient
-	partitionKey PartitionKey
+	db              *azcosmos.ContainerClient
+	archive         *azcosmos.ContainerClient
+	leases          *azcosmos.ContainerClient
+	partitionKey    PartitionKey
+	readConsistency *azcosmos.ConsistencyLevel
+}
+
+// Maps a MongoDB read preference mode to the consistency of read-only queries. Modes that allow reading
+// from secondaries use eventual consistency so any replica can serve them, primary keeps the account default.
+func parseReadConsistency(mode string) (*azcosmos.ConsistencyLevel, error) {
+	switch strings.ToLower(mode) {
+	case "", "primary":
+		return nil, nil
+	case "primarypreferred", "secondary", "secondarypreferred", "nearest":
+		consistency := azcosmos.ConsistencyLevelEventual
+		return &consistency, nil
+	}
+	return nil, fmt.Errorf("unknown read preference %v", mode)
 }
 
-func NewCosmosDBOrderRepoWithManagedIdentity(cosmosDbEndpoint string, dbName string, containerName string, partitionKey PartitionKey) (*CosmosDBOrderRepo, error) {
+func NewCosmosDBOrderRepoWithManagedIdentity(cosmosDbEndpoint string, dbName string, containerName string, archiveContainerName string, leaseContainerName string, partitionKey PartitionKey, readConsistency *azcosmos.ConsistencyLevel) (*CosmosDBOrderRepo, error) {
 	cred, err := azidentity.NewDefaultAzureCredential(nil)
 	if err != nil {
 		log.Printf("failed to create cosmosdb workload identity credential: %v\n", err)
@@ -45,10 +74,24 @@ func NewCosmosDBOrderRepoWithManagedIdentity(cosmosDbEndpoint string, dbName str
 		return nil, err
 	}
 
-	return &CosmosDBOrderRepo{container, partitionKey}, nil
+	// create a cosmos container for archived orders
+	archive, err := client.NewContainer(dbName, archiveContainerName)
+	if err != nil {
+		log.Printf("failed to create cosmosdb archive container: %v\n", err)
+		return nil, err
+	}
+
+	// create a cosmos container for leases
+	leases, err := client.NewContainer(dbName, leaseContainerName)
+	if err != nil {
+		log.Printf("failed to create cosmosdb lease container: %v\n", err)
+		return nil, err
+	}
+
+	return &CosmosDBOrderRepo{container, archive, leases, partitionKey, readConsistency}, nil
 }
 
-func NewCosmosDBOrderRepo(cosmosDbEndpoint string, dbName string, containerName string, cosmosDbKey string, partitionKey PartitionKey) (*CosmosDBOrderRepo, error) {
+func NewCosmosDBOrderRepo(cosmosDbEndpoint string, dbName string, containerName string, archiveContainerName string, leaseContainerName string, cosmosDbKey string, partitionKey PartitionKey, readConsistency *azcosmos.ConsistencyLevel) (*CosmosDBOrderRepo, error) {
 	cred, err := azcosmos.NewKeyCredential(cosmosDbKey)
 	if err != nil {
 		log.Printf("failed to create cosmosdb key credential: %v\n", err)
@@ -69,19 +112,54 @@ func NewCosmosDBOrderRepo(cosmosDbEndpoint string, dbName string, containerName
 		return nil, err
 	}
 
-	return &CosmosDBOrderRepo{container, partitionKey}, nil
+	// create a cosmos container for archived orders
+	archive, err := client.NewContainer(dbName, archiveContainerName)
+	if err != nil {
+		log.Printf("failed to create cosmosdb archive container: %v\n", err)
+		return nil, err
+	}
+
+	// create a cosmos container for leases
+	leases, err := client.NewContainer(dbName, leaseContainerName)
+	if err != nil {
+		log.Printf("failed to create cosmosdb lease container: %v\n", err)
+		return nil, err
+	}
+
+	return &CosmosDBOrderRepo{container, archive, leases, partitionKey, readConsistency}, nil
 }
 
-func (r *CosmosDBOrderRepo) GetPendingOrders() ([]Order, error) {
+func (r *CosmosDBOrderRepo) GetPendingOrders(opts PendingOrdersOptions) ([]Order, error) {
 	var orders []Order
 
-	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	// the sort field has already been validated so it is safe to use in the query
+	sortDirection := "ASC"
+	if opts.Sort.Descending {
+		sortDirection = "DESC"
+	}
+
 	opt := &azcosmos.QueryOptions{
 		QueryParameters: []azcosmos.QueryParameter{
-			{Name: "@status", Value: Pending},
+			{Name: "@status", Value: int(Pending)},
+			{Name: "@statusName", Value: Pending.String()},
 		},
+		ConsistencyLevel: r.readConsistency,
 	}
-	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.status = @status", pk, opt)
+	query := "SELECT * FROM o WHERE o.status IN (@status, @statusName)"
+	if !opts.CreatedAfter.IsZero() {
+		query += " AND o.createdAt >= @createdAfter"
+		opt.QueryParameters = append(opt.QueryParameters, azcosmos.QueryParameter{Name: "@createdAfter", Value: opts.CreatedAfter.UTC()})
+	}
+	if !opts.CreatedBefore.IsZero() {
+		query += " AND o.createdAt < @createdBefore"
+		opt.QueryParameters = append(opt.QueryParameters, azcosmos.QueryParameter{Name: "@createdBefore", Value: opts.CreatedBefore.UTC()})
+	}
+	// order IDs are strings, so they are sorted here to compare numeric IDs as numbers
+	sortHere := r.crossPartition() || opts.Sort.Field == SortByOrderID
+	if !sortHere {
+		query += fmt.Sprintf(" ORDER BY o.%s %s", opts.Sort.Field, sortDirection)
+	}
+	queryPager := r.db.NewQueryItemsPager(query, r.queryPartitionKey(), opt)
 
 	for queryPager.More() {
 		queryResponse, err := queryPager.NextPage(context.Background())
@@ -100,24 +178,61 @@ func (r *CosmosDBOrderRepo) GetPendingOrders() ([]Order, error) {
 			orders = append(orders, order)
 		}
 	}
+
+	// the gateway can't order queries across partitions, so sort them here instead
+	if sortHere {
+		sortOrders(orders, opts.Sort)
+	}
 	return orders, nil
 }
 
 func (r *CosmosDBOrderRepo) GetOrder(id string) (Order, error) {
-	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	return r.getOrder(id, r.readConsistency)
+}
+
+// GetOrderForUpdate reads with the account's default consistency instead of readConsistency
+func (r *CosmosDBOrderRepo) GetOrderForUpdate(id string) (Order, error) {
+	return r.getOrder(id, nil)
+}
+
+func (r *CosmosDBOrderRepo) getOrder(id string, consistency *azcosmos.ConsistencyLevel) (Order, error) {
+	var requestCharge float32
+	defer func() { recordRequestCharge("read", requestCharge) }()
+
+	order, err := r.queryOrder(r.db, id, consistency, &requestCharge)
+	if errors.Is(err, ErrOrderNotFound) {
+		// fall back to the archive for completed orders that have been archived
+		order, err = r.queryOrder(r.archive, id, consistency, &requestCharge)
+	}
+	if errors.Is(err, ErrOrderNotFound) && !r.crossPartition() {
+		// report an order stored under another partition value the same way as updates do
+		return Order{}, r.findOrderPartitions(id)
+	}
+	return order, err
+}
+
+// Queries a container for an order with a consistency level, or the account default if it is nil, adding
+// the request units used to requestCharge
+func (r *CosmosDBOrderRepo) queryOrder(container *azcosmos.ContainerClient, id string, consistency *azcosmos.ConsistencyLevel, requestCharge *float32) (Order, error) {
 	opt := &azcosmos.QueryOptions{
 		QueryParameters: []azcosmos.QueryParameter{
 			{Name: "@orderId", Value: id},
 		},
+		ConsistencyLevel: consistency,
 	}
-	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", pk, opt)
+	queryPager := container.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", r.queryPartitionKey(), opt)
 
 	for queryPager.More() {
 		queryResponse, err := queryPager.NextPage(context.Background())
 		if err != nil {
+			var responseErr *azcore.ResponseError
+			if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusNotFound {
+				return Order{}, ErrOrderNotFound
+			}
 			log.Printf("failed to get next page: %v\n", err)
 			return Order{}, err
 		}
+		*requestCharge += queryResponse.RequestCharge
 
 		for _, item := range queryResponse.Items {
 			var order Order
@@ -129,14 +244,21 @@ func (r *CosmosDBOrderRepo) GetOrder(id string) (Order, error) {
 			return order, nil
 		}
 	}
-	return Order{}, nil
+	return Order{}, ErrOrderNotFound
 }
 
 func (r *CosmosDBOrderRepo) InsertOrders(orders []Order) error {
 	var counter = 0
 
 	for _, o := range orders {
-		pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+		partitionValue := r.partitionKey.Value
+		if r.crossPartition() {
+			if o.StoreID == "" {
+				return fmt.Errorf("order %s has no storeId to partition it by", o.OrderID)
+			}
+			partitionValue = o.StoreID
+		}
+		pk := azcosmos.NewPartitionKeyString(partitionValue)
 
 		marshalledOrder, err := json.Marshal(o)
 		if err != nil {
@@ -160,7 +282,7 @@ func (r *CosmosDBOrderRepo) InsertOrders(orders []Order) error {
 		uuid := strings.Replace(uuidWithHyphen.String(), "-", "", -1)
 		order["id"] = uuid
 
-		order[r.partitionKey.Key] = r.partitionKey.Value
+		order[r.partitionKey.Key] = partitionValue
 
 		marshalledOrder, err = json.Marshal(order)
 		if err != nil {
@@ -168,11 +290,12 @@ func (r *CosmosDBOrderRepo) InsertOrders(orders []Order) error {
 			return err
 		}
 
-		_, err = r.db.CreateItem(context.Background(), pk, marshalledOrder, nil)
+		itemResponse, err := r.db.CreateItem(context.Background(), pk, marshalledOrder, nil)
 		if err != nil {
 			log.Printf("failed to create item: %v\n", err)
 			return err
 		}
+		recordRequestCharge("insert", itemResponse.RequestCharge)
 
 		// increment counter for each order inserted
 		counter++
@@ -184,19 +307,159 @@ func (r *CosmosDBOrderRepo) InsertOrders(orders []Order) error {
 }
 
 func (r *CosmosDBOrderRepo) UpdateOrder(order Order) error {
-	var existingOrderId string
-	pk := azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+	var requestCharge float32
+	defer func() { recordRequestCharge("update", requestCharge) }()
+
+	existingOrder, pk, err := r.findOrderItem(order.OrderID, &requestCharge)
+	if err != nil {
+		return err
+	}
+
+	if order.UpdatedAt.IsZero() {
+		order.UpdatedAt = time.Now().UTC()
+	}
+
+	patch := azcosmos.PatchOperations{}
+	patch.AppendReplace("/status", order.Status)
+	patch.AppendSet("/updatedAt", order.UpdatedAt)
+	appendHistory(&patch, existingOrder, StatusChange{Status: order.Status, At: order.UpdatedAt, Actor: order.LastModifiedBy})
+	if order.ExternalRef != "" {
+		patch.AppendSet("/externalRef", order.ExternalRef)
+	}
+	patch.AppendSet("/lastModifiedBy", order.LastModifiedBy)
+
+	itemResponse, err := r.db.PatchItem(context.Background(), pk, existingOrder["id"].(string), patch, nil)
+	if err != nil {
+		log.Printf("failed to replace item: %v\n", err)
+		return err
+	}
+	requestCharge += itemResponse.RequestCharge
+
+	return nil
+}
+
+func (r *CosmosDBOrderRepo) TransitionOrder(id string, from []Status, change StatusChange) (Order, error) {
+	var requestCharge float32
+	defer func() { recordRequestCharge("update", requestCharge) }()
+
+	existingOrder, pk, err := r.findOrderItem(id, &requestCharge)
+	if err != nil {
+		return Order{}, err
+	}
+
+	if change.At.IsZero() {
+		change.At = time.Now().UTC()
+	}
+
+	// the condition is checked by the database as part of the patch, so the order can't change in between
+	statuses := make([]string, 0, 2*len(from))
+	for _, status := range from {
+		statuses = append(statuses, statusValues(status)...)
+	}
+
+	patch := transitionPatch(existingOrder, fmt.Sprintf("FROM o WHERE o.status IN (%s)", strings.Join(statuses, ", ")), change)
+
+	itemResponse, err := r.db.PatchItem(context.Background(), pk, existingOrder["id"].(string), patch, &azcosmos.ItemOptions{EnableContentResponseOnWrite: true})
+	if err != nil {
+		var responseErr *azcore.ResponseError
+		if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusPreconditionFailed {
+			return Order{}, ErrPreconditionFailed
+		}
+		log.Printf("failed to patch item: %v\n", err)
+		return Order{}, err
+	}
+	requestCharge += itemResponse.RequestCharge
+
+	var order Order
+	err = json.Unmarshal(itemResponse.Value, &order)
+	if err != nil {
+		log.Printf("failed to deserialize order: %v\n", err)
+		return Order{}, err
+	}
+	return order, nil
+}
+
+// Renders a status for a query as both the number it was stored as before statuses were written
+// by name, and its name, so items stored either way match. The name is single quoted because patch
+// conditions are written into the request body without escaping double quotes.
+func statusValues(status Status) []string {
+	return []string{strconv.Itoa(int(status)), "'" + status.String() + "'"}
+}
+
+// Builds a patch that moves an item to the status of the change and records the change, only if the item
+// still matches the condition when the patch is applied
+func transitionPatch(item map[string]interface{}, condition string, change StatusChange) azcosmos.PatchOperations {
+	patch := azcosmos.PatchOperations{}
+	patch.SetCondition(condition)
+	patch.AppendReplace("/status", change.Status)
+	patch.AppendSet("/updatedAt", change.At)
+	appendHistory(&patch, item, change)
+	patch.AppendSet("/lastModifiedBy", change.Actor)
+	if change.ExternalRef != "" {
+		patch.AppendSet("/externalRef", change.ExternalRef)
+	}
+	return patch
+}
+
+// Adds a status change to the history of an item, creating the history for items stored before it was recorded
+func appendHistory(patch *azcosmos.PatchOperations, item map[string]interface{}, change StatusChange) {
+	if _, ok := item["history"]; ok {
+		patch.AppendAdd("/history/-", change)
+	} else {
+		patch.AppendSet("/history", []StatusChange{change})
+	}
+}
+
+// Finds the item of an order and its partition key, adding the request units used to requestCharge
+func (r *CosmosDBOrderRepo) findOrderItem(orderId string, requestCharge *float32) (map[string]interface{}, azcosmos.PartitionKey, error) {
 	opt := &azcosmos.QueryOptions{
 		QueryParameters: []azcosmos.QueryParameter{
-			{Name: "@orderId", Value: order.OrderID},
+			{Name: "@orderId", Value: orderId},
 		},
 	}
-	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", pk, opt)
+	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", r.queryPartitionKey(), opt)
 
 	for queryPager.More() {
 		queryResponse, err := queryPager.NextPage(context.Background())
 		if err != nil {
-			break
+			log.Printf("failed to get next page: %v\n", err)
+			return nil, azcosmos.PartitionKey{}, err
+		}
+		*requestCharge += queryResponse.RequestCharge
+
+		for _, item := range queryResponse.Items {
+			var order map[string]interface{}
+			err = json.Unmarshal(item, &order)
+			if err != nil {
+				log.Printf("failed to deserialize order: %v\n", err)
+				return nil, azcosmos.PartitionKey{}, err
+			}
+			return order, r.itemPartitionKey(order), nil
+		}
+	}
+
+	if r.crossPartition() {
+		return nil, azcosmos.PartitionKey{}, ErrOrderNotFound
+	}
+	log.Printf("order %s not found in partition %s=%s\n", orderId, r.partitionKey.Key, r.partitionKey.Value)
+	return nil, azcosmos.PartitionKey{}, r.findOrderPartitions(orderId)
+}
+
+// Looks for an order across all partitions to tell a partition mismatch apart from a missing order
+func (r *CosmosDBOrderRepo) findOrderPartitions(orderId string) error {
+	opt := &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@orderId", Value: orderId},
+		},
+	}
+	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.orderId = @orderId", azcosmos.NewPartitionKey(), opt)
+
+	var partitionValues []string
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(context.Background())
+		if err != nil {
+			log.Printf("failed to query order across partitions: %v\n", err)
+			return err
 		}
 
 		for _, item := range queryResponse.Items {
@@ -206,19 +469,516 @@ func (r *CosmosDBOrderRepo) UpdateOrder(order Order) error {
 				log.Printf("failed to deserialize order: %v\n", err)
 				return err
 			}
-			existingOrderId = order["id"].(string)
-			break
+			partitionValues = append(partitionValues, fmt.Sprint(order[r.partitionKey.Key]))
 		}
 	}
 
-	patch := azcosmos.PatchOperations{}
-	patch.AppendReplace("/status", order.Status)
+	if len(partitionValues) == 0 {
+		return ErrOrderNotFound
+	}
+
+	err := &PartitionMismatchError{
+		OrderID:         orderId,
+		PartitionValue:  r.partitionKey.Value,
+		PartitionValues: partitionValues,
+	}
+	log.Printf("partition mismatch: %v\n", err)
+	return err
+}
+
+func (r *CosmosDBOrderRepo) CountByStatus() (map[Status]int, error) {
+	counts := make(map[Status]int)
+
+	// the gateway can't group queries across partitions, so count the statuses here instead
+	if r.crossPartition() {
+		queryPager := r.db.NewQueryItemsPager("SELECT VALUE o.status FROM o", r.queryPartitionKey(), &azcosmos.QueryOptions{ConsistencyLevel: r.readConsistency})
+		for queryPager.More() {
+			queryResponse, err := queryPager.NextPage(context.Background())
+			if err != nil {
+				log.Printf("failed to get next page: %v\n", err)
+				return nil, err
+			}
+
+			for _, item := range queryResponse.Items {
+				var status Status
+				err := json.Unmarshal(item, &status)
+				if err != nil {
+					log.Printf("failed to deserialize status: %v\n", err)
+					return nil, err
+				}
+				counts[status]++
+			}
+		}
+		return counts, nil
+	}
+
+	queryPager := r.db.NewQueryItemsPager("SELECT o.status, COUNT(1) AS count FROM o GROUP BY o.status", r.queryPartitionKey(), &azcosmos.QueryOptions{ConsistencyLevel: r.readConsistency})
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(context.Background())
+		if err != nil {
+			log.Printf("failed to get next page: %v\n", err)
+			return nil, err
+		}
+
+		for _, item := range queryResponse.Items {
+			var result struct {
+				Status Status `json:"status"`
+				Count  int    `json:"count"`
+			}
+			err := json.Unmarshal(item, &result)
+			if err != nil {
+				log.Printf("failed to deserialize status count: %v\n", err)
+				return nil, err
+			}
+			counts[result.Status] += result.Count
+		}
+	}
+	return counts, nil
+}
+
+func (r *CosmosDBOrderRepo) GetOrdersByLastModifiedBy(actor string, page Page) ([]Order, error) {
+	orders := []Order{}
+
+	opt := &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@actor", Value: actor},
+		},
+	}
+	query := "SELECT * FROM o WHERE o.lastModifiedBy = @actor"
+	if !r.crossPartition() {
+		query += " ORDER BY o.createdAt OFFSET @offset LIMIT @limit"
+		opt.QueryParameters = append(opt.QueryParameters,
+			azcosmos.QueryParameter{Name: "@offset", Value: page.Offset},
+			azcosmos.QueryParameter{Name: "@limit", Value: page.Limit},
+		)
+	}
+	queryPager := r.db.NewQueryItemsPager(query, r.queryPartitionKey(), opt)
+
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(context.Background())
+		if err != nil {
+			log.Printf("failed to get next page: %v\n", err)
+			return nil, err
+		}
+
+		for _, item := range queryResponse.Items {
+			var order Order
+			err := json.Unmarshal(item, &order)
+			if err != nil {
+				log.Printf("failed to deserialize order: %v\n", err)
+				return nil, err
+			}
+			orders = append(orders, order)
+		}
+	}
+
+	// the gateway can't order or page queries across partitions, so do it here instead
+	if r.crossPartition() {
+		sortOrders(orders, OrderSort{Field: SortByCreatedAt})
+		start := min(page.Offset, len(orders))
+		end := min(start+page.Limit, len(orders))
+		orders = orders[start:end]
+	}
+	return orders, nil
+}
+
+func (r *CosmosDBOrderRepo) SearchOrders(search OrderSearch, page Page) ([]Order, error) {
+	orders := []Order{}
+
+	// only searchable fields are ever added to the query, and their values are always parameters
+	opt := &azcosmos.QueryOptions{ConsistencyLevel: r.readConsistency}
+	conditions := []string{"true"}
+	addCondition := func(condition string, name string, value any) {
+		conditions = append(conditions, condition)
+		opt.QueryParameters = append(opt.QueryParameters, azcosmos.QueryParameter{Name: name, Value: value})
+	}
+	if search.CustomerID != "" {
+		addCondition("o.customerId = @customerId", "@customerId", search.CustomerID)
+	}
+	if search.Status != nil {
+		addCondition("o.status IN (@status, @statusName)", "@status", int(*search.Status))
+		opt.QueryParameters = append(opt.QueryParameters, azcosmos.QueryParameter{Name: "@statusName", Value: search.Status.String()})
+	}
+	if search.StoreID != "" {
+		addCondition("o.storeId = @storeId", "@storeId", search.StoreID)
+	}
+	if search.LastModifiedBy != "" {
+		addCondition("o.lastModifiedBy = @lastModifiedBy", "@lastModifiedBy", search.LastModifiedBy)
+	}
+	if !search.CreatedAfter.IsZero() {
+		addCondition("o.createdAt >= @createdAfter", "@createdAfter", search.CreatedAfter.UTC())
+	}
+	if !search.CreatedBefore.IsZero() {
+		addCondition("o.createdAt < @createdBefore", "@createdBefore", search.CreatedBefore.UTC())
+	}
+
+	query := "SELECT * FROM o WHERE " + strings.Join(conditions, " AND ")
+	if !r.crossPartition() {
+		query += " ORDER BY o.createdAt OFFSET @offset LIMIT @limit"
+		opt.QueryParameters = append(opt.QueryParameters,
+			azcosmos.QueryParameter{Name: "@offset", Value: page.Offset},
+			azcosmos.QueryParameter{Name: "@limit", Value: page.Limit},
+		)
+	}
+	queryPager := r.db.NewQueryItemsPager(query, r.queryPartitionKey(), opt)
+
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(context.Background())
+		if err != nil {
+			log.Printf("failed to get next page: %v\n", err)
+			return nil, err
+		}
+
+		for _, item := range queryResponse.Items {
+			var order Order
+			err := json.Unmarshal(item, &order)
+			if err != nil {
+				log.Printf("failed to deserialize order: %v\n", err)
+				return nil, err
+			}
+			orders = append(orders, order)
+		}
+	}
+
+	// the gateway can't order or page queries across partitions, so do it here instead
+	if r.crossPartition() {
+		sortOrders(orders, OrderSort{Field: SortByCreatedAt})
+		start := min(page.Offset, len(orders))
+		end := min(start+page.Limit, len(orders))
+		orders = orders[start:end]
+	}
+	return orders, nil
+}
+
+func (r *CosmosDBOrderRepo) RecoverStuckOrders(stuckFor time.Duration, change StatusChange) (int, error) {
+	ctx := context.Background()
+
+	if change.At.IsZero() {
+		change.At = time.Now().UTC()
+	}
+	cutoff := change.At.Add(-stuckFor)
+
+	// orders stored before updates were tracked fall back to when they were created
+	opt := &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@status", Value: int(Processing)},
+			{Name: "@statusName", Value: Processing.String()},
+			{Name: "@cutoff", Value: cutoff},
+		},
+	}
+	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.status IN (@status, @statusName) AND (o.updatedAt < @cutoff OR (NOT IS_DEFINED(o.updatedAt) AND o.createdAt < @cutoff))", r.queryPartitionKey(), opt)
+
+	// a batch can only change items in one partition, so group the stuck items by partition
+	partitions := make(map[string][]map[string]interface{})
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(ctx)
+		if err != nil {
+			log.Printf("failed to get next page: %v\n", err)
+			return 0, err
+		}
 
-	_, err := r.db.PatchItem(context.Background(), pk, existingOrderId, patch, nil)
+		for _, item := range queryResponse.Items {
+			var order map[string]interface{}
+			err := json.Unmarshal(item, &order)
+			if err != nil {
+				log.Printf("failed to deserialize order: %v\n", err)
+				return 0, err
+			}
+			value := fmt.Sprint(order[r.partitionKey.Key])
+			partitions[value] = append(partitions[value], order)
+		}
+	}
+
+	// only recover orders that are still stuck when the patch is applied
+	cutoffJSON, err := json.Marshal(cutoff)
 	if err != nil {
-		log.Printf("failed to replace item: %v\n", err)
+		return 0, err
+	}
+	condition := fmt.Sprintf("FROM o WHERE o.status IN (%s) AND (NOT IS_DEFINED(o.updatedAt) OR o.updatedAt < '%s')", strings.Join(statusValues(Processing), ", "), strings.Trim(string(cutoffJSON), `"`))
+
+	recovered := 0
+	for value, items := range partitions {
+		pk := azcosmos.NewPartitionKeyString(value)
+
+		for chunk := range slices.Chunk(items, cosmosMaxBatchOperations) {
+			batch := r.db.NewTransactionalBatch(pk)
+			for _, item := range chunk {
+				batch.PatchItem(item["id"].(string), transitionPatch(item, condition, change), nil)
+			}
+
+			batchResponse, err := r.db.ExecuteTransactionalBatch(ctx, batch, nil)
+			if err != nil {
+				log.Printf("failed to execute batch: %v\n", err)
+				return recovered, err
+			}
+			if batchResponse.Success {
+				recovered += len(chunk)
+				continue
+			}
+
+			// an order changed after it was found, which rolls back the whole batch, so patch the orders one by one
+			for _, item := range chunk {
+				_, err := r.db.PatchItem(ctx, pk, item["id"].(string), transitionPatch(item, condition, change), nil)
+				if err != nil {
+					var responseErr *azcore.ResponseError
+					if errors.As(err, &responseErr) && responseErr.StatusCode == http.StatusPreconditionFailed {
+						continue
+					}
+					log.Printf("failed to patch item: %v\n", err)
+					return recovered, err
+				}
+				recovered++
+			}
+		}
+	}
+
+	log.Printf("Recovered %v stuck orders\n", recovered)
+	return recovered, nil
+}
+
+func (r *CosmosDBOrderRepo) ArchiveCompletedOrders(olderThan time.Duration) (int, error) {
+	var counter = 0
+
+	opt := &azcosmos.QueryOptions{
+		QueryParameters: []azcosmos.QueryParameter{
+			{Name: "@status", Value: int(Complete)},
+			{Name: "@statusName", Value: Complete.String()},
+			{Name: "@cutoff", Value: time.Now().UTC().Add(-olderThan)},
+		},
+	}
+	// orders are archived by when they were completed, and orders stored before updates were tracked
+	// fall back to when they were created
+	queryPager := r.db.NewQueryItemsPager("SELECT * FROM o WHERE o.status IN (@status, @statusName) AND (o.updatedAt < @cutoff OR (NOT IS_DEFINED(o.updatedAt) AND (NOT IS_DEFINED(o.createdAt) OR o.createdAt < @cutoff)))", r.queryPartitionKey(), opt)
+
+	for queryPager.More() {
+		queryResponse, err := queryPager.NextPage(context.Background())
+		if err != nil {
+			log.Printf("failed to get next page: %v\n", err)
+			return counter, err
+		}
+
+		for _, item := range queryResponse.Items {
+			var order map[string]interface{}
+			err := json.Unmarshal(item, &order)
+			if err != nil {
+				log.Printf("failed to deserialize order: %v\n", err)
+				return counter, err
+			}
+			pk := r.itemPartitionKey(order)
+
+			// copy the order to the archive before removing it so it is never lost
+			_, err = r.archive.UpsertItem(context.Background(), pk, item, nil)
+			if err != nil {
+				log.Printf("failed to archive item: %v\n", err)
+				return counter, err
+			}
+
+			// only remove the order if it is unchanged since it was found, and take the archived copy back
+			// out if it was updated in between, such as by being reopened
+			etag := azcore.ETag(fmt.Sprint(order["_etag"]))
+			_, err = r.db.DeleteItem(context.Background(), pk, order["id"].(string), &azcosmos.ItemOptions{IfMatchEtag: &etag})
+			if isCosmosStatus(err, http.StatusPreconditionFailed) {
+				_, err = r.archive.DeleteItem(context.Background(), pk, order["id"].(string), nil)
+				if err != nil && !isCosmosStatus(err, http.StatusNotFound) {
+					log.Printf("failed to remove item updated while it was archived: %v\n", err)
+					return counter, err
+				}
+				continue
+			}
+			if err != nil {
+				log.Printf("failed to delete archived item: %v\n", err)
+				return counter, err
+			}
+
+			counter++
+		}
+	}
+
+	log.Printf("Archived %v documents\n", counter)
+
+	return counter, nil
+}
+
+// cosmosLease is a lease stored in the lease container, which must be partitioned by the same key as orders
+type cosmosLease struct {
+	Holder    string    `json:"holder"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// Leases are stored in the configured partition, or in a partition of their own if orders span partitions
+func (r *CosmosDBOrderRepo) leasePartitionKey(name string) (azcosmos.PartitionKey, string) {
+	if r.partitionKey.Value != "" {
+		return azcosmos.NewPartitionKeyString(r.partitionKey.Value), r.partitionKey.Value
+	}
+	return azcosmos.NewPartitionKeyString(name), name
+}
+
+func (r *CosmosDBOrderRepo) AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	pk, partitionValue := r.leasePartitionKey(name)
+	now := time.Now().UTC()
+
+	item, err := json.Marshal(map[string]interface{}{
+		"id":               name,
+		r.partitionKey.Key: partitionValue,
+		"holder":           holder,
+		"expiresAt":        now.Add(ttl),
+	})
+	if err != nil {
+		return false, err
+	}
+
+	response, err := r.leases.ReadItem(ctx, pk, name, nil)
+	if isCosmosStatus(err, http.StatusNotFound) {
+		// another instance creating the lease at the same time gets a conflict
+		_, err = r.leases.CreateItem(ctx, pk, item, nil)
+		if isCosmosStatus(err, http.StatusConflict) {
+			return false, nil
+		}
+		if err != nil {
+			log.Printf("failed to create lease %s: %v\n", name, err)
+			return false, err
+		}
+		return true, nil
+	}
+	if err != nil {
+		log.Printf("failed to read lease %s: %v\n", name, err)
+		return false, err
+	}
+
+	var current cosmosLease
+	if err := json.Unmarshal(response.Value, &current); err != nil {
+		return false, err
+	}
+	if current.Holder != holder && current.ExpiresAt.After(now) {
+		return false, nil
+	}
+
+	// only replace the lease read above, so two instances taking over an expired lease can't both succeed
+	_, err = r.leases.ReplaceItem(ctx, pk, name, item, &azcosmos.ItemOptions{IfMatchEtag: &response.ETag})
+	if isCosmosStatus(err, http.StatusPreconditionFailed) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("failed to renew lease %s: %v\n", name, err)
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *CosmosDBOrderRepo) ReleaseLease(ctx context.Context, name string, holder string) error {
+	pk, _ := r.leasePartitionKey(name)
+
+	response, err := r.leases.ReadItem(ctx, pk, name, nil)
+	if isCosmosStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	if err != nil {
+		log.Printf("failed to read lease %s: %v\n", name, err)
 		return err
 	}
 
+	var current cosmosLease
+	if err := json.Unmarshal(response.Value, &current); err != nil {
+		return err
+	}
+	if current.Holder != holder {
+		return nil
+	}
+
+	_, err = r.leases.DeleteItem(ctx, pk, name, &azcosmos.ItemOptions{IfMatchEtag: &response.ETag})
+	if err != nil && !isCosmosStatus(err, http.StatusNotFound) && !isCosmosStatus(err, http.StatusPreconditionFailed) {
+		log.Printf("failed to release lease %s: %v\n", name, err)
+		return err
+	}
+	return nil
+}
+
+// Reports whether err is a Cosmos DB response with the status code
+func isCosmosStatus(err error, statusCode int) bool {
+	var responseErr *azcore.ResponseError
+	return errors.As(err, &responseErr) && responseErr.StatusCode == statusCode
+}
+
+func (r *CosmosDBOrderRepo) Ping(ctx context.Context) error {
+	_, err := r.db.Read(ctx, nil)
+	return err
+}
+
+// Reports whether orders are partitioned by store rather than all stored in one partition
+func (r *CosmosDBOrderRepo) crossPartition() bool {
+	return r.partitionKey.Value == ""
+}
+
+// Returns the partition key to query, which spans every partition when orders are partitioned by store
+func (r *CosmosDBOrderRepo) queryPartitionKey() azcosmos.PartitionKey {
+	if r.crossPartition() {
+		return azcosmos.NewPartitionKey()
+	}
+	return azcosmos.NewPartitionKeyString(r.partitionKey.Value)
+}
+
+// Returns the partition key of an item read from the container
+func (r *CosmosDBOrderRepo) itemPartitionKey(item map[string]interface{}) azcosmos.PartitionKey {
+	return azcosmos.NewPartitionKeyString(fmt.Sprint(item[r.partitionKey.Key]))
+}
+
+func (r *CosmosDBOrderRepo) EnsureIndexes(ctx context.Context) error {
+	paths := make([]string, len(indexedFields))
+	for i, field := range indexedFields {
+		paths[i] = "/" + field + "/?"
+	}
+
+	if err := ensureCosmosIndexes(ctx, r.db, paths); err != nil {
+		return err
+	}
+	// archived orders are only looked up by ID
+	return ensureCosmosIndexes(ctx, r.archive, []string{"/orderId/?"})
+}
+
+// Adds the paths that aren't indexed yet to the indexing policy of a container. Containers index every
+// path by default, in which case nothing needs to change.
+func ensureCosmosIndexes(ctx context.Context, container *azcosmos.ContainerClient, paths []string) error {
+	response, err := container.Read(ctx, nil)
+	if err != nil {
+		log.Printf("failed to read container %s: %v\n", container.ID(), err)
+		return err
+	}
+	properties := *response.ContainerProperties
+
+	policy := properties.IndexingPolicy
+	if policy == nil {
+		policy = &azcosmos.IndexingPolicy{Automatic: true, IndexingMode: azcosmos.IndexingModeConsistent}
+		properties.IndexingPolicy = policy
+	}
+
+	included := make(map[string]bool, len(policy.IncludedPaths))
+	for _, path := range policy.IncludedPaths {
+		included[path.Path] = true
+	}
+
+	var missing []string
+	for _, path := range paths {
+		if included["/*"] || included[path] {
+			log.Printf("Path %s of %s is already indexed", path, container.ID())
+			continue
+		}
+		missing = append(missing, path)
+		policy.IncludedPaths = append(policy.IncludedPaths, azcosmos.IncludedPath{Path: path})
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+
+	_, err = container.Replace(ctx, properties, nil)
+	if err != nil {
+		log.Printf("failed to update indexing policy of %s: %v\n", container.ID(), err)
+		return err
+	}
+	log.Printf("Indexed paths %s of %s", strings.Join(missing, ", "), container.ID())
 	return nil
 }
+
+// Records the request units consumed by an operation on a single order
+func recordRequestCharge(operation string, charge float32) {
+	observeHistogram(cosmosRequestUnits, operation, requestUnitBuckets, float64(charge))
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/Azure/azure-sdk-for-go/sdk/messaging/azservicebus"
+	"github.com/gin-gonic/gin"
+)
+
+// How long to wait for dead-lettered messages to retry before assuming there are none
+const deadLetterReceiveTimeout = 5 * time.Second
+
+// DeadLetter is a message the broker moved to the dead-letter queue because it couldn't be processed
+type DeadLetter struct {
+	MessageID     string     `json:"messageId"`
+	Body          string     `json:"body"`
+	Reason        string     `json:"reason,omitempty"`
+	Description   string     `json:"description,omitempty"`
+	DeliveryCount uint32     `json:"deliveryCount"`
+	EnqueuedAt    *time.Time `json:"enqueuedAt,omitempty"`
+}
+
+// DeadLetterQueue inspects and retries the messages dead-lettered from the order queue
+type DeadLetterQueue interface {
+	// Peek returns up to max dead-lettered messages without removing them
+	Peek(ctx context.Context, max int) ([]DeadLetter, error)
+	// Retry moves up to max dead-lettered messages back to the order queue, returning how many were moved
+	Retry(ctx context.Context, max int) (int, error)
+}
+
+// ServiceBusDeadLetterQueue is the dead-letter sub-queue of an Azure Service Bus queue, which Service Bus
+// moves messages to once they have been delivered more times than the queue's maximum delivery count
+type ServiceBusDeadLetterQueue struct {
+	hostName  string
+	queueName string
+}
+
+func NewServiceBusDeadLetterQueue(hostName string, queueName string) *ServiceBusDeadLetterQueue {
+	return &ServiceBusDeadLetterQueue{hostName, queueName}
+}
+
+func (q *ServiceBusDeadLetterQueue) client() (*azservicebus.Client, error) {
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		log.Printf("failed to obtain a workload identity credential: %v", err)
+		return nil, err
+	}
+
+	client, err := azservicebus.NewClient(q.hostName, cred, nil)
+	if err != nil {
+		log.Printf("failed to obtain a service bus client with workload identity credential: %v", err)
+		return nil, err
+	}
+	return client, nil
+}
+
+func (q *ServiceBusDeadLetterQueue) Peek(ctx context.Context, max int) ([]DeadLetter, error) {
+	client, err := q.client()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close(ctx)
+
+	receiver, err := client.NewReceiverForQueue(q.queueName, &azservicebus.ReceiverOptions{SubQueue: azservicebus.SubQueueDeadLetter})
+	if err != nil {
+		log.Printf("failed to create dead-letter receiver: %v", err)
+		return nil, err
+	}
+	defer receiver.Close(ctx)
+
+	messages, err := receiver.PeekMessages(ctx, max, nil)
+	if err != nil {
+		log.Printf("failed to peek dead-lettered messages: %v", err)
+		return nil, err
+	}
+
+	deadLetters := make([]DeadLetter, len(messages))
+	for i, message := range messages {
+		deadLetters[i] = DeadLetter{
+			MessageID:     message.MessageID,
+			Body:          string(message.Body),
+			DeliveryCount: message.DeliveryCount,
+			EnqueuedAt:    message.EnqueuedTime,
+		}
+		if message.DeadLetterReason != nil {
+			deadLetters[i].Reason = *message.DeadLetterReason
+		}
+		if message.DeadLetterErrorDescription != nil {
+			deadLetters[i].Description = *message.DeadLetterErrorDescription
+		}
+	}
+	return deadLetters, nil
+}
+
+func (q *ServiceBusDeadLetterQueue) Retry(ctx context.Context, max int) (int, error) {
+	client, err := q.client()
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close(ctx)
+
+	receiver, err := client.NewReceiverForQueue(q.queueName, &azservicebus.ReceiverOptions{SubQueue: azservicebus.SubQueueDeadLetter})
+	if err != nil {
+		log.Printf("failed to create dead-letter receiver: %v", err)
+		return 0, err
+	}
+	defer receiver.Close(ctx)
+
+	sender, err := client.NewSender(q.queueName, nil)
+	if err != nil {
+		log.Printf("failed to create sender: %v", err)
+		return 0, err
+	}
+	defer sender.Close(ctx)
+
+	// receiving waits for messages to arrive, so give up once it's clear there are none
+	receiveCtx, cancel := context.WithTimeout(ctx, deadLetterReceiveTimeout)
+	messages, err := receiver.ReceiveMessages(receiveCtx, max, nil)
+	cancel()
+	if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+		log.Printf("failed to receive dead-lettered messages: %v", err)
+		return 0, err
+	}
+
+	// each message is only removed from the dead-letter queue once it has been sent to the order queue
+	retried := 0
+	for _, message := range messages {
+		if err := sender.SendMessage(ctx, message.Message(), nil); err != nil {
+			log.Printf("failed to send dead-lettered message %s: %v", message.MessageID, err)
+			if err := receiver.AbandonMessage(ctx, message, nil); err != nil {
+				log.Printf("failed to abandon dead-lettered message %s: %v", message.MessageID, err)
+			}
+			return retried, err
+		}
+		if err := receiver.CompleteMessage(ctx, message, nil); err != nil {
+			log.Printf("failed to complete dead-lettered message %s: %v", message.MessageID, err)
+			return retried, err
+		}
+		retried++
+	}
+	return retried, nil
+}
+
+// Parses the limit query parameter of dead-letter requests
+func parseDeadLetterLimit(c *gin.Context) (int, error) {
+	limit := 10
+	if value := c.Query("limit"); value != "" {
+		l, err := strconv.Atoi(value)
+		if err != nil || l < 1 || l > 100 {
+			return 0, fmt.Errorf("limit must be an integer between 1 and 100")
+		}
+		limit = l
+	}
+	return limit, nil
+}
+
+// Lists messages in the dead-letter queue of the order queue without removing them
+func getDeadLetters(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if client.deadLetters == nil {
+		abortWithError(c, http.StatusNotImplemented, "dead_letter_unsupported", "the order queue has no dead-letter queue")
+		return
+	}
+
+	limit, err := parseDeadLetterLimit(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	stopTiming := timePhase(c, "queue")
+	deadLetters, err := client.deadLetters.Peek(c.Request.Context(), limit)
+	stopTiming()
+	if err != nil {
+		log.Printf("Failed to peek dead-lettered messages: %s", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respond(c, http.StatusOK, deadLetters)
+}
+
+// Moves messages in the dead-letter queue back to the order queue to be processed again
+func retryDeadLetters(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	if client.deadLetters == nil {
+		abortWithError(c, http.StatusNotImplemented, "dead_letter_unsupported", "the order queue has no dead-letter queue")
+		return
+	}
+
+	limit, err := parseDeadLetterLimit(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	stopTiming := timePhase(c, "queue")
+	retried, err := client.deadLetters.Retry(c.Request.Context(), limit)
+	stopTiming()
+	log.Printf("Moved %d dead-lettered messages back to the order queue", retried)
+	if err != nil {
+		log.Printf("Failed to retry dead-lettered messages: %s", err)
+		abortWithError(c, http.StatusBadGateway, "publish_failed", fmt.Sprintf("moved %d dead-lettered messages back to the order queue before failing", retried))
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"retried": retried})
+}
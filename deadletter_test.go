@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeDeadLetterQueue keeps dead-lettered messages in memory and can fail to peek or to move them back
+type fakeDeadLetterQueue struct {
+	messages []DeadLetter
+	requeued []DeadLetter
+	peekErr  error
+	// failAfter fails a retry once that many messages have been moved back, if set
+	failAfter int
+}
+
+func (q *fakeDeadLetterQueue) Peek(ctx context.Context, max int) ([]DeadLetter, error) {
+	if q.peekErr != nil {
+		return nil, q.peekErr
+	}
+	return q.messages[:min(max, len(q.messages))], nil
+}
+
+func (q *fakeDeadLetterQueue) Retry(ctx context.Context, max int) (int, error) {
+	retried := 0
+	for len(q.messages) > 0 && retried < max {
+		if q.failAfter > 0 && retried == q.failAfter {
+			return retried, errors.New("send failed")
+		}
+		q.requeued = append(q.requeued, q.messages[0])
+		q.messages = q.messages[1:]
+		retried++
+	}
+	return retried, nil
+}
+
+func newDeadLetterTestRouter(queue DeadLetterQueue) *gin.Engine {
+	service := NewOrderService(NewInMemoryOrderRepo())
+	if queue != nil {
+		service.deadLetters = queue
+	}
+
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(OrderMiddleware(service))
+	router.GET("/deadletter", AdminAuthMiddleware("secret"), getDeadLetters)
+	router.POST("/deadletter/retry", AdminAuthMiddleware("secret"), retryDeadLetters)
+	return router
+}
+
+func serveDeadLetters(router http.Handler, method string, path string, apiKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("X-API-Key", apiKey)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func testDeadLetters(n int) []DeadLetter {
+	deadLetters := make([]DeadLetter, n)
+	for i := range deadLetters {
+		deadLetters[i] = DeadLetter{MessageID: string(rune('a' + i)), Body: "{}", Reason: "MaxDeliveryCountExceeded", DeliveryCount: 10}
+	}
+	return deadLetters
+}
+
+func TestGetDeadLetters(t *testing.T) {
+	tests := []struct {
+		name     string
+		queue    *fakeDeadLetterQueue
+		query    string
+		apiKey   string
+		wantCode int
+		wantIDs  []string
+	}{
+		{name: "peeks up to the default limit", queue: &fakeDeadLetterQueue{messages: testDeadLetters(12)}, apiKey: "secret", wantCode: http.StatusOK, wantIDs: []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}},
+		{name: "peeks up to the limit", queue: &fakeDeadLetterQueue{messages: testDeadLetters(3)}, query: "?limit=2", apiKey: "secret", wantCode: http.StatusOK, wantIDs: []string{"a", "b"}},
+		{name: "empty queue", queue: &fakeDeadLetterQueue{}, apiKey: "secret", wantCode: http.StatusOK, wantIDs: []string{}},
+		{name: "invalid limit", queue: &fakeDeadLetterQueue{}, query: "?limit=0", apiKey: "secret", wantCode: http.StatusBadRequest},
+		{name: "peek fails", queue: &fakeDeadLetterQueue{peekErr: errors.New("unreachable")}, apiKey: "secret", wantCode: http.StatusInternalServerError},
+		{name: "no dead-letter queue", apiKey: "secret", wantCode: http.StatusNotImplemented},
+		{name: "without the admin key", queue: &fakeDeadLetterQueue{messages: testDeadLetters(1)}, apiKey: "wrong", wantCode: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queue DeadLetterQueue
+			if tt.queue != nil {
+				queue = tt.queue
+			}
+			w := serveDeadLetters(newDeadLetterTestRouter(queue), http.MethodGet, "/deadletter"+tt.query, tt.apiKey)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if tt.wantIDs == nil {
+				return
+			}
+
+			var deadLetters []DeadLetter
+			if err := json.Unmarshal(w.Body.Bytes(), &deadLetters); err != nil {
+				t.Fatal(err)
+			}
+			ids := make([]string, len(deadLetters))
+			for i, deadLetter := range deadLetters {
+				ids[i] = deadLetter.MessageID
+				if deadLetter.Reason == "" {
+					t.Errorf("dead letter %s has no reason", deadLetter.MessageID)
+				}
+			}
+			if !slices.Equal(ids, tt.wantIDs) {
+				t.Errorf("got dead letters %v, want %v", ids, tt.wantIDs)
+			}
+			if len(tt.queue.requeued) != 0 {
+				t.Errorf("peeking moved %d messages back to the order queue", len(tt.queue.requeued))
+			}
+		})
+	}
+}
+
+func TestRetryDeadLetters(t *testing.T) {
+	tests := []struct {
+		name         string
+		queue        *fakeDeadLetterQueue
+		query        string
+		apiKey       string
+		wantCode     int
+		wantRetried  int
+		wantRequeued int
+		wantLeft     int
+	}{
+		{name: "moves messages back up to the default limit", queue: &fakeDeadLetterQueue{messages: testDeadLetters(12)}, apiKey: "secret", wantCode: http.StatusOK, wantRetried: 10, wantRequeued: 10, wantLeft: 2},
+		{name: "moves messages back up to the limit", queue: &fakeDeadLetterQueue{messages: testDeadLetters(3)}, query: "?limit=2", apiKey: "secret", wantCode: http.StatusOK, wantRetried: 2, wantRequeued: 2, wantLeft: 1},
+		{name: "empty queue", queue: &fakeDeadLetterQueue{}, apiKey: "secret", wantCode: http.StatusOK},
+		{name: "fails part way", queue: &fakeDeadLetterQueue{messages: testDeadLetters(3), failAfter: 1}, apiKey: "secret", wantCode: http.StatusBadGateway, wantRequeued: 1, wantLeft: 2},
+		{name: "invalid limit", queue: &fakeDeadLetterQueue{messages: testDeadLetters(1)}, query: "?limit=101", apiKey: "secret", wantCode: http.StatusBadRequest, wantLeft: 1},
+		{name: "without the admin key", queue: &fakeDeadLetterQueue{messages: testDeadLetters(1)}, apiKey: "wrong", wantCode: http.StatusForbidden, wantLeft: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := serveDeadLetters(newDeadLetterTestRouter(tt.queue), http.MethodPost, "/deadletter/retry"+tt.query, tt.apiKey)
+			if w.Code != tt.wantCode {
+				t.Fatalf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if len(tt.queue.requeued) != tt.wantRequeued || len(tt.queue.messages) != tt.wantLeft {
+				t.Errorf("got %d moved back and %d left, want %d and %d", len(tt.queue.requeued), len(tt.queue.messages), tt.wantRequeued, tt.wantLeft)
+			}
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+
+			var body struct {
+				Retried int `json:"retried"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			if body.Retried != tt.wantRetried {
+				t.Errorf("got %d retried, want %d", body.Retried, tt.wantRetried)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Prefix of encrypted field values, followed by the key ID and the base64 encoded nonce and ciphertext
+const encryptedFieldPrefix = "enc:"
+
+// Order fields that can be encrypted, by their JSON name
+var encryptableFields = map[string]func(*Order) *string{
+	"customerId":  func(o *Order) *string { return &o.CustomerID },
+	"externalRef": func(o *Order) *string { return &o.ExternalRef },
+}
+
+// FieldEncrypter encrypts and decrypts field values with AES-GCM. Values are encrypted with the
+// active key and tagged with its ID, so older keys can still decrypt values after a rotation.
+type FieldEncrypter struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+}
+
+// Creates a FieldEncrypter from a comma separated list of keyID:base64key pairs. The first key is
+// used to encrypt and every key can decrypt.
+func NewFieldEncrypter(keySpec string) (*FieldEncrypter, error) {
+	e := &FieldEncrypter{keys: make(map[string]cipher.AEAD)}
+
+	for _, pair := range strings.Split(keySpec, ",") {
+		keyID, encodedKey, ok := strings.Cut(strings.TrimSpace(pair), ":")
+		if !ok || keyID == "" {
+			return nil, errors.New("keys must be in the form keyID:base64key")
+		}
+
+		key, err := base64.StdEncoding.DecodeString(encodedKey)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not valid base64: %w", keyID, err)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("key %s is not a valid AES key: %w", keyID, err)
+		}
+
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+
+		if e.activeKeyID == "" {
+			e.activeKeyID = keyID
+		}
+		e.keys[keyID] = aead
+	}
+
+	return e, nil
+}
+
+func (e *FieldEncrypter) Encrypt(plaintext string) (string, error) {
+	aead := e.keys[e.activeKeyID]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), nil)
+	return encryptedFieldPrefix + e.activeKeyID + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt returns values that weren't encrypted unchanged
+func (e *FieldEncrypter) Decrypt(value string) (string, error) {
+	if !strings.HasPrefix(value, encryptedFieldPrefix) {
+		return value, nil
+	}
+
+	keyID, encoded, ok := strings.Cut(strings.TrimPrefix(value, encryptedFieldPrefix), ":")
+	if !ok {
+		return "", errors.New("encrypted value is missing its key ID")
+	}
+
+	aead, ok := e.keys[keyID]
+	if !ok {
+		return "", fmt.Errorf("no key configured for key ID %s", keyID)
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("encrypted value is too short")
+	}
+
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// EncryptedOrderRepo encrypts the configured order fields before they are written to another
+// order repo and decrypts them when they are read back
+type EncryptedOrderRepo struct {
+	repo      OrderRepo
+	encrypter *FieldEncrypter
+	fields    []func(*Order) *string
+}
+
+func NewEncryptedOrderRepo(repo OrderRepo, encrypter *FieldEncrypter, fieldNames []string) (*EncryptedOrderRepo, error) {
+	r := &EncryptedOrderRepo{repo: repo, encrypter: encrypter}
+
+	for _, name := range fieldNames {
+		field, ok := encryptableFields[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("field %s can't be encrypted", name)
+		}
+		r.fields = append(r.fields, field)
+	}
+
+	return r, nil
+}
+
+func (r *EncryptedOrderRepo) GetPendingOrders(opts PendingOrdersOptions) ([]Order, error) {
+	orders, err := r.repo.GetPendingOrders(opts)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		if err := r.decrypt(&orders[i]); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func (r *EncryptedOrderRepo) GetOrder(id string) (Order, error) {
+	order, err := r.repo.GetOrder(id)
+	if err != nil {
+		return order, err
+	}
+	if err := r.decrypt(&order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (r *EncryptedOrderRepo) GetOrderForUpdate(id string) (Order, error) {
+	order, err := r.repo.GetOrderForUpdate(id)
+	if err != nil {
+		return order, err
+	}
+	if err := r.decrypt(&order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (r *EncryptedOrderRepo) InsertOrders(orders []Order) error {
+	encrypted := make([]Order, len(orders))
+	for i, order := range orders {
+		if err := r.encrypt(&order); err != nil {
+			return err
+		}
+		encrypted[i] = order
+	}
+	return r.repo.InsertOrders(encrypted)
+}
+
+func (r *EncryptedOrderRepo) UpdateOrder(order Order) error {
+	if err := r.encrypt(&order); err != nil {
+		return err
+	}
+	return r.repo.UpdateOrder(order)
+}
+
+func (r *EncryptedOrderRepo) TransitionOrder(id string, from []Status, change StatusChange) (Order, error) {
+	// the external reference of the change is written to the order, so it is encrypted like the order's
+	changed := Order{ExternalRef: change.ExternalRef}
+	if err := r.encrypt(&changed); err != nil {
+		return Order{}, err
+	}
+	change.ExternalRef = changed.ExternalRef
+
+	order, err := r.repo.TransitionOrder(id, from, change)
+	if err != nil {
+		return order, err
+	}
+	if err := r.decrypt(&order); err != nil {
+		return Order{}, err
+	}
+	return order, nil
+}
+
+func (r *EncryptedOrderRepo) CountByStatus() (map[Status]int, error) {
+	return r.repo.CountByStatus()
+}
+
+func (r *EncryptedOrderRepo) ArchiveCompletedOrders(olderThan time.Duration) (int, error) {
+	return r.repo.ArchiveCompletedOrders(olderThan)
+}
+
+func (r *EncryptedOrderRepo) RecoverStuckOrders(stuckFor time.Duration, change StatusChange) (int, error) {
+	return r.repo.RecoverStuckOrders(stuckFor, change)
+}
+
+func (r *EncryptedOrderRepo) Ping(ctx context.Context) error {
+	return r.repo.Ping(ctx)
+}
+
+func (r *EncryptedOrderRepo) EnsureIndexes(ctx context.Context) error {
+	return r.repo.EnsureIndexes(ctx)
+}
+
+func (r *EncryptedOrderRepo) SearchOrders(search OrderSearch, page Page) ([]Order, error) {
+	// encrypted values differ every time they are encrypted, so they can't be matched
+	searched := Order{CustomerID: search.CustomerID}
+	for _, field := range r.fields {
+		if *field(&searched) != "" {
+			return nil, ErrEncryptedFieldSearch
+		}
+	}
+
+	orders, err := r.repo.SearchOrders(search, page)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		if err := r.decrypt(&orders[i]); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func (r *EncryptedOrderRepo) GetOrdersByLastModifiedBy(actor string, page Page) ([]Order, error) {
+	orders, err := r.repo.GetOrdersByLastModifiedBy(actor, page)
+	if err != nil {
+		return nil, err
+	}
+	for i := range orders {
+		if err := r.decrypt(&orders[i]); err != nil {
+			return nil, err
+		}
+	}
+	return orders, nil
+}
+
+func (r *EncryptedOrderRepo) encrypt(order *Order) error {
+	for _, field := range r.fields {
+		value := field(order)
+		if *value == "" {
+			continue
+		}
+		encrypted, err := r.encrypter.Encrypt(*value)
+		if err != nil {
+			return fmt.Errorf("failed to encrypt field: %w", err)
+		}
+		*value = encrypted
+	}
+	return nil
+}
+
+func (r *EncryptedOrderRepo) decrypt(order *Order) error {
+	for _, field := range r.fields {
+		value := field(order)
+		decrypted, err := r.encrypter.Decrypt(*value)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt field of order %s: %w", order.OrderID, err)
+		}
+		*value = decrypted
+	}
+	return nil
+}
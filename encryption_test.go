@@ -0,0 +1,212 @@
+package main
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// 256 bit AES keys, base64 encoded
+var (
+	testKey1 = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testKey2 = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func TestNewFieldEncrypter(t *testing.T) {
+	tests := []struct {
+		name    string
+		keySpec string
+		wantErr bool
+	}{
+		{name: "one key", keySpec: "k1:" + testKey1},
+		{name: "several keys", keySpec: "k2:" + testKey2 + ", k1:" + testKey1},
+		{name: "128 bit key", keySpec: "k1:" + base64.StdEncoding.EncodeToString([]byte("0123456789abcdef"))},
+		{name: "missing key ID", keySpec: ":" + testKey1, wantErr: true},
+		{name: "missing separator", keySpec: testKey1, wantErr: true},
+		{name: "invalid base64", keySpec: "k1:not base64", wantErr: true},
+		{name: "invalid key size", keySpec: "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewFieldEncrypter(tt.keySpec)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func newTestFieldEncrypter(t *testing.T, keySpec string) *FieldEncrypter {
+	t.Helper()
+	encrypter, err := NewFieldEncrypter(keySpec)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return encrypter
+}
+
+func TestFieldEncrypterRoundTrip(t *testing.T) {
+	encrypter := newTestFieldEncrypter(t, "k1:"+testKey1)
+
+	for _, plaintext := range []string{"customer-1", "", "ünïcödé", strings.Repeat("x", 1000)} {
+		encrypted, err := encrypter.Encrypt(plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(encrypted, encryptedFieldPrefix+"k1:") {
+			t.Errorf("got %q, want it tagged with the active key", encrypted)
+		}
+		if plaintext != "" && strings.Contains(encrypted, plaintext) {
+			t.Errorf("encrypted value %q contains the plaintext", encrypted)
+		}
+
+		decrypted, err := encrypter.Decrypt(encrypted)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if decrypted != plaintext {
+			t.Errorf("got %q after a round trip, want %q", decrypted, plaintext)
+		}
+	}
+
+	// a fresh nonce is used every time
+	first, _ := encrypter.Encrypt("customer-1")
+	second, _ := encrypter.Encrypt("customer-1")
+	if first == second {
+		t.Errorf("encrypting the same value twice gave the same result %q", first)
+	}
+}
+
+func TestFieldEncrypterKeyRotation(t *testing.T) {
+	old := newTestFieldEncrypter(t, "k1:"+testKey1)
+	encryptedWithOld, err := old.Encrypt("customer-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated := newTestFieldEncrypter(t, "k2:"+testKey2+",k1:"+testKey1)
+	encryptedWithNew, err := rotated.Encrypt("customer-2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encryptedWithNew, encryptedFieldPrefix+"k2:") {
+		t.Errorf("got %q, want it encrypted with the new key", encryptedWithNew)
+	}
+
+	tests := []struct {
+		name      string
+		encrypter *FieldEncrypter
+		value     string
+		want      string
+		wantErr   bool
+	}{
+		{name: "rotated keys decrypt values of the old key", encrypter: rotated, value: encryptedWithOld, want: "customer-1"},
+		{name: "rotated keys decrypt values of the new key", encrypter: rotated, value: encryptedWithNew, want: "customer-2"},
+		{name: "old key can't decrypt values of the new key", encrypter: old, value: encryptedWithNew, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.encrypter.Decrypt(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFieldEncrypterDecrypt(t *testing.T) {
+	encrypter := newTestFieldEncrypter(t, "k1:"+testKey1)
+	encrypted, err := encrypter.Encrypt("customer-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed := strings.TrimPrefix(encrypted, encryptedFieldPrefix+"k1:")
+	tampered, _ := base64.StdEncoding.DecodeString(sealed)
+	tampered[len(tampered)-1] ^= 1
+
+	tests := []struct {
+		name    string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{name: "encrypted value", value: encrypted, want: "customer-1"},
+		{name: "plaintext written before encryption was enabled", value: "customer-1", want: "customer-1"},
+		{name: "empty value", value: "", want: ""},
+		{name: "unknown key ID", value: encryptedFieldPrefix + "k9:" + sealed, wantErr: true},
+		{name: "missing key ID", value: encryptedFieldPrefix + sealed, wantErr: true},
+		{name: "invalid base64", value: encryptedFieldPrefix + "k1:not base64", wantErr: true},
+		{name: "too short", value: encryptedFieldPrefix + "k1:" + base64.StdEncoding.EncodeToString([]byte("short")), wantErr: true},
+		{name: "tampered ciphertext", value: encryptedFieldPrefix + "k1:" + base64.StdEncoding.EncodeToString(tampered), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := encrypter.Decrypt(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEncryptedOrderRepo(t *testing.T) {
+	memory := NewInMemoryOrderRepo()
+	repo, err := NewEncryptedOrderRepo(memory, newTestFieldEncrypter(t, "k1:"+testKey1), []string{"customerId", "externalRef"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// order 1 was stored before encryption was enabled
+	memory.InsertOrders([]Order{{OrderID: "1", CustomerID: "customer-1", Status: Pending}})
+	if err := repo.InsertOrders([]Order{{OrderID: "2", CustomerID: "customer-2", Status: Pending}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.TransitionOrder("2", []Status{Pending}, StatusChange{Status: Complete, ExternalRef: "inv-2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name         string
+		id           string
+		wantCustomer string
+		wantRef      string
+		wantStored   bool
+	}{
+		{name: "plaintext order", id: "1", wantCustomer: "customer-1"},
+		{name: "encrypted order", id: "2", wantCustomer: "customer-2", wantRef: "inv-2", wantStored: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, err := repo.GetOrder(tt.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.CustomerID != tt.wantCustomer || order.ExternalRef != tt.wantRef {
+				t.Errorf("got customer %q and reference %q, want %q and %q", order.CustomerID, order.ExternalRef, tt.wantCustomer, tt.wantRef)
+			}
+
+			stored, _ := memory.GetOrder(tt.id)
+			encrypted := strings.HasPrefix(stored.CustomerID, encryptedFieldPrefix)
+			if encrypted != tt.wantStored {
+				t.Errorf("got customer stored as %q, want encrypted %v", stored.CustomerID, tt.wantStored)
+			}
+			if tt.wantRef != "" && !strings.HasPrefix(stored.ExternalRef, encryptedFieldPrefix) {
+				t.Errorf("got reference stored as %q, want it encrypted", stored.ExternalRef)
+			}
+		})
+	}
+
+	if _, err := NewEncryptedOrderRepo(memory, newTestFieldEncrypter(t, "k1:"+testKey1), []string{"status"}); err == nil {
+		t.Errorf("got no error encrypting a field that can't be encrypted")
+	}
+}
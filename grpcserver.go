@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"aks-store-demo/makeline-service/orderpb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// orderGRPCServer serves the order API over gRPC from the same order service as the REST API
+type orderGRPCServer struct {
+	orderpb.UnimplementedOrderServiceServer
+	service *OrderService
+}
+
+func NewGRPCServer(service *OrderService) *grpc.Server {
+	server := grpc.NewServer()
+	orderpb.RegisterOrderServiceServer(server, &orderGRPCServer{service: service})
+	return server
+}
+
+func (s *orderGRPCServer) GetOrder(ctx context.Context, req *orderpb.GetOrderRequest) (*orderpb.Order, error) {
+	orderId, err := sanitizeOrderID(req.GetOrderId())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid order id: %s", err)
+	}
+
+	order, err := s.service.repo.GetOrder(orderId)
+	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			return nil, status.Errorf(codes.NotFound, "order %s not found", orderId)
+		}
+		log.Printf("Failed to get order from database: %s", err)
+		return nil, status.Error(codes.Internal, "failed to get order")
+	}
+
+	return toProtoOrder(order), nil
+}
+
+func (s *orderGRPCServer) UpdateOrder(ctx context.Context, req *orderpb.UpdateOrderRequest) (*orderpb.UpdateOrderResponse, error) {
+	order := Order{
+		OrderID:        req.GetOrderId(),
+		Status:         Status(req.GetStatus()),
+		ExternalRef:    req.GetExternalRef(),
+		LastModifiedBy: req.GetActor(),
+	}
+
+	// Orders are updated the same way as with the REST API
+	update, err := s.service.UpdateOrder(ctx, order)
+	if err != nil {
+		var validationErr *ValidationError
+		var transitionErr *InvalidTransitionError
+		switch {
+		case errors.As(err, &validationErr):
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		case errors.Is(err, ErrOrderNotFound):
+			return nil, status.Errorf(codes.NotFound, "order %s not found", order.OrderID)
+		case errors.Is(err, ErrExternalRefConflict):
+			return nil, status.Errorf(codes.AlreadyExists, "order %s was already completed with a different external reference", order.OrderID)
+		case errors.Is(err, ErrPreconditionFailed), errors.Is(err, ErrConfirmationRequired), errors.As(err, &transitionErr):
+			return nil, status.Errorf(codes.FailedPrecondition, "invalid update of order %s: %s", order.OrderID, err)
+		default:
+			log.Printf("Failed to update order in database: %s", err)
+			return nil, status.Error(codes.Internal, "failed to update order")
+		}
+	}
+
+	return &orderpb.UpdateOrderResponse{Status: orderpb.OrderStatus(update.Status), Unchanged: update.Unchanged}, nil
+}
+
+func (s *orderGRPCServer) ListPendingOrders(ctx context.Context, req *orderpb.ListPendingOrdersRequest) (*orderpb.ListPendingOrdersResponse, error) {
+	sort, err := ParseOrderSort(req.GetSort())
+	if err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid sort: %s", err)
+	}
+
+	orders, err := s.service.repo.GetPendingOrders(PendingOrdersOptions{Sort: sort})
+	if err != nil {
+		log.Printf("Failed to get pending orders from database: %s", err)
+		return nil, status.Error(codes.Internal, "failed to get pending orders")
+	}
+
+	resp := &orderpb.ListPendingOrdersResponse{}
+	for _, order := range orders {
+		resp.Orders = append(resp.Orders, toProtoOrder(order))
+	}
+	return resp, nil
+}
+
+func toProtoOrder(order Order) *orderpb.Order {
+	order.backfill()
+	o := &orderpb.Order{
+		OrderId:        order.OrderID,
+		CustomerId:     order.CustomerID,
+		Status:         orderpb.OrderStatus(order.Status),
+		ExternalRef:    order.ExternalRef,
+		LastModifiedBy: order.LastModifiedBy,
+		Total:          order.Total,
+		StoreId:        order.StoreID,
+	}
+	if !order.CreatedAt.IsZero() {
+		o.CreatedAt = timestamppb.New(order.CreatedAt)
+	}
+	if !order.UpdatedAt.IsZero() {
+		o.UpdatedAt = timestamppb.New(order.UpdatedAt)
+	}
+	for _, item := range order.Items {
+		o.Items = append(o.Items, &orderpb.Item{
+			ProductId: int32(item.Product),
+			Quantity:  int32(item.Quantity),
+			Price:     item.Price,
+		})
+	}
+	return o
+}
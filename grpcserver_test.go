@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"aks-store-demo/makeline-service/orderpb"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestUpdateOrderRESTAndGRPCAgree(t *testing.T) {
+	tests := []struct {
+		name        string
+		existing    *Order
+		orderId     string
+		status      Status
+		externalRef string
+		// threshold enables confirmation for orders totaling at least that much
+		threshold     float64
+		wantHTTP      int
+		wantGRPC      codes.Code
+		wantStatus    Status
+		wantUnchanged bool
+	}{
+		{name: "completes a pending order", existing: &Order{OrderID: "1", Status: Pending}, orderId: "1", status: Complete, externalRef: "inv-1", wantHTTP: http.StatusAccepted, wantGRPC: codes.OK, wantStatus: Complete},
+		{name: "same reference again is a no-op", existing: &Order{OrderID: "1", Status: Complete, ExternalRef: "inv-1"}, orderId: "1", status: Complete, externalRef: "inv-1", wantHTTP: http.StatusOK, wantGRPC: codes.OK, wantStatus: Complete, wantUnchanged: true},
+		{name: "different reference conflicts", existing: &Order{OrderID: "1", Status: Complete, ExternalRef: "inv-1"}, orderId: "1", status: Complete, externalRef: "inv-2", wantHTTP: http.StatusConflict, wantGRPC: codes.AlreadyExists, wantStatus: Complete},
+		{name: "transitions aren't checked without confirmation", existing: &Order{OrderID: "1", Status: Cancelled}, orderId: "1", status: Complete, wantHTTP: http.StatusAccepted, wantGRPC: codes.OK, wantStatus: Complete},
+		{name: "invalid transition", existing: &Order{OrderID: "1", Status: Cancelled}, orderId: "1", status: Complete, externalRef: "inv-1", wantHTTP: http.StatusConflict, wantGRPC: codes.FailedPrecondition, wantStatus: Cancelled},
+		{name: "awaiting confirmation", existing: &Order{OrderID: "1", Status: PendingCompletion}, orderId: "1", status: Complete, externalRef: "inv-1", wantHTTP: http.StatusConflict, wantGRPC: codes.FailedPrecondition, wantStatus: PendingCompletion},
+		{name: "completing needs to be confirmed", existing: &Order{OrderID: "1", Status: Pending, Items: []Item{{Product: 1, Quantity: 1, Price: 100}}}, orderId: "1", status: Complete, threshold: 50, wantHTTP: http.StatusAccepted, wantGRPC: codes.OK, wantStatus: PendingCompletion},
+		{name: "transitions are checked with confirmation", existing: &Order{OrderID: "1", Status: Cancelled}, orderId: "1", status: Complete, threshold: 50, wantHTTP: http.StatusConflict, wantGRPC: codes.FailedPrecondition, wantStatus: Cancelled},
+		{name: "unsupported status", existing: &Order{OrderID: "1", Status: Pending}, orderId: "1", status: Pending, wantHTTP: http.StatusBadRequest, wantGRPC: codes.InvalidArgument, wantStatus: Pending},
+		{name: "invalid order id", orderId: "abc", status: Complete, wantHTTP: http.StatusBadRequest, wantGRPC: codes.InvalidArgument},
+		{name: "not found", orderId: "1", status: Complete, wantHTTP: http.StatusNotFound, wantGRPC: codes.NotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			confirmationThreshold = tt.threshold
+			defer func() { confirmationThreshold = 0 }()
+
+			newService := func() (*OrderService, *InMemoryOrderRepo) {
+				repo := NewInMemoryOrderRepo()
+				if tt.existing != nil {
+					repo.InsertOrders([]Order{*tt.existing})
+				}
+				return NewOrderService(repo), repo
+			}
+
+			restService, restRepo := newService()
+			w := serveJSON(newTestRouter(restService), http.MethodPut, "/order", gin.H{"orderId": tt.orderId, "status": tt.status, "externalRef": tt.externalRef})
+			if w.Code != tt.wantHTTP {
+				t.Errorf("got HTTP status %d, want %d", w.Code, tt.wantHTTP)
+			}
+
+			grpcService, grpcRepo := newService()
+			server := &orderGRPCServer{service: grpcService}
+			resp, err := server.UpdateOrder(context.Background(), &orderpb.UpdateOrderRequest{OrderId: tt.orderId, Status: orderpb.OrderStatus(tt.status), ExternalRef: tt.externalRef})
+			if code := status.Code(err); code != tt.wantGRPC {
+				t.Errorf("got gRPC code %s, want %s", code, tt.wantGRPC)
+			}
+			if err == nil && (Status(resp.GetStatus()) != tt.wantStatus || resp.GetUnchanged() != tt.wantUnchanged) {
+				t.Errorf("got gRPC response with status %s and unchanged %v, want %s and %v", Status(resp.GetStatus()), resp.GetUnchanged(), tt.wantStatus, tt.wantUnchanged)
+			}
+
+			if tt.existing == nil {
+				return
+			}
+			for api, repo := range map[string]*InMemoryOrderRepo{"REST": restRepo, "gRPC": grpcRepo} {
+				order, _ := repo.GetOrder(tt.orderId)
+				if order.Status != tt.wantStatus {
+					t.Errorf("got order %s after the %s update, want %s", order.Status, api, tt.wantStatus)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Name of the lease held by the instance that drains the order queue
+const consumerLeaseName = "order-consumer"
+
+// LeaseStore records which instance holds a lease and until when, so that instances sharing a database can
+// agree on a single holder
+type LeaseStore interface {
+	// AcquireLease takes the lease for holder until ttl from now if it is free, has expired or is already held
+	// by holder, and reports whether holder now holds it
+	AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error)
+	// ReleaseLease gives up the lease if holder holds it, so another instance can take it straight away
+	ReleaseLease(ctx context.Context, name string, holder string) error
+}
+
+// Lease is renewed in the background by the instance holding it. Another instance takes it over once the
+// holder stops renewing it for longer than the TTL.
+type Lease struct {
+	store         LeaseStore
+	name          string
+	holder        string
+	ttl           time.Duration
+	renewInterval time.Duration
+	clock         Clock
+
+	mu        sync.Mutex
+	heldUntil time.Time
+}
+
+func NewLease(store LeaseStore, name string, holder string, ttl time.Duration, renewInterval time.Duration, clock Clock) *Lease {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &Lease{store: store, name: name, holder: holder, ttl: ttl, renewInterval: renewInterval, clock: clock}
+}
+
+// Identifies this instance as a lease holder, by its host name, which is the pod name on Kubernetes, and a
+// random suffix in case instances share a host
+func leaseHolderID() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "makeline-service"
+	}
+	return fmt.Sprintf("%s-%s", hostname, uuid.Must(uuid.NewV4()).String()[:8])
+}
+
+// Held reports whether this instance holds the lease. It stops being held once the TTL passes without a
+// successful renewal, even if the store couldn't be reached to find out whether another instance took it.
+func (l *Lease) Held() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clock.Now().Before(l.heldUntil)
+}
+
+// Renew acquires or renews the lease and reports whether it is held
+func (l *Lease) Renew(ctx context.Context) bool {
+	wasHeld := l.Held()
+	start := l.clock.Now()
+
+	acquired, err := l.store.AcquireLease(ctx, l.name, l.holder, l.ttl)
+	if err != nil {
+		log.Printf("Failed to renew lease %s: %s", l.name, err)
+	}
+
+	l.mu.Lock()
+	if acquired {
+		// measured from before the request, so this instance never believes it holds the lease for longer than the store does
+		l.heldUntil = start.Add(l.ttl)
+	}
+	held := l.clock.Now().Before(l.heldUntil)
+	l.mu.Unlock()
+
+	if held && !wasHeld {
+		log.Printf("Acquired lease %s as %s", l.name, l.holder)
+	} else if !held && wasHeld {
+		log.Printf("Lost lease %s", l.name)
+	}
+	return held
+}
+
+// Run renews the lease every renewal interval until the context is cancelled, then releases it
+func (l *Lease) Run(ctx context.Context) {
+	for {
+		l.Renew(ctx)
+
+		select {
+		case <-ctx.Done():
+			l.release()
+			return
+		case <-time.After(l.renewInterval):
+		}
+	}
+}
+
+func (l *Lease) release() {
+	if !l.Held() {
+		return
+	}
+
+	l.mu.Lock()
+	l.heldUntil = time.Time{}
+	l.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+	defer cancel()
+	if err := l.store.ReleaseLease(ctx, l.name, l.holder); err != nil {
+		log.Printf("Failed to release lease %s: %s", l.name, err)
+		return
+	}
+	log.Printf("Released lease %s", l.name)
+}
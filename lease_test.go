@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeLeaseStore keeps leases in memory and expires them by a fake clock. It can be made unreachable.
+type fakeLeaseStore struct {
+	mu          sync.Mutex
+	clock       Clock
+	leases      map[string]memoryLease
+	unreachable bool
+}
+
+func newFakeLeaseStore(clock Clock) *fakeLeaseStore {
+	return &fakeLeaseStore{clock: clock, leases: make(map[string]memoryLease)}
+}
+
+func (s *fakeLeaseStore) AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unreachable {
+		return false, errors.New("lease store unreachable")
+	}
+	now := s.clock.Now()
+	if lease, ok := s.leases[name]; ok && lease.holder != holder && lease.expiresAt.After(now) {
+		return false, nil
+	}
+	s.leases[name] = memoryLease{holder, now.Add(ttl)}
+	return true, nil
+}
+
+func (s *fakeLeaseStore) ReleaseLease(ctx context.Context, name string, holder string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.unreachable {
+		return errors.New("lease store unreachable")
+	}
+	if lease, ok := s.leases[name]; ok && lease.holder == holder {
+		delete(s.leases, name)
+	}
+	return nil
+}
+
+func TestLease(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		// instance is "a" or "b"
+		instance string
+		// action is "renew" or "release"
+		action      string
+		unreachable bool
+		wantA       bool
+		wantB       bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "first instance acquires the lease",
+			steps: []step{
+				{instance: "a", action: "renew", wantA: true},
+				{instance: "b", action: "renew", wantA: true},
+			},
+		},
+		{
+			name: "holder keeps the lease by renewing it",
+			steps: []step{
+				{instance: "a", action: "renew", wantA: true},
+				{advance: 10 * time.Second, instance: "a", action: "renew", wantA: true},
+				{advance: 10 * time.Second, instance: "b", action: "renew", wantA: true},
+				{advance: 10 * time.Second, instance: "a", action: "renew", wantA: true},
+				{advance: 10 * time.Second, instance: "b", action: "renew", wantA: true},
+			},
+		},
+		{
+			name: "another instance takes over once the lease expires",
+			steps: []step{
+				{instance: "a", action: "renew", wantA: true},
+				{advance: 10 * time.Second, instance: "b", action: "renew", wantA: true},
+				{advance: 6 * time.Second, instance: "b", action: "renew", wantB: true},
+				{instance: "a", action: "renew", wantB: true},
+			},
+		},
+		{
+			name: "another instance takes over straight away once the lease is released",
+			steps: []step{
+				{instance: "a", action: "renew", wantA: true},
+				{instance: "a", action: "release"},
+				{instance: "b", action: "renew", wantB: true},
+				{advance: 10 * time.Second, instance: "a", action: "renew", wantB: true},
+			},
+		},
+		{
+			name: "holder stops holding the lease when the store can't be reached for the TTL",
+			steps: []step{
+				{instance: "a", action: "renew", wantA: true},
+				{advance: 10 * time.Second, instance: "a", action: "renew", unreachable: true, wantA: true},
+				{advance: 6 * time.Second, instance: "a", action: "renew", unreachable: true},
+				{instance: "a", action: "renew", wantA: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			store := newFakeLeaseStore(clock)
+			leases := map[string]*Lease{
+				"a": NewLease(store, consumerLeaseName, "a", 15*time.Second, 5*time.Second, clock),
+				"b": NewLease(store, consumerLeaseName, "b", 15*time.Second, 5*time.Second, clock),
+			}
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				store.mu.Lock()
+				store.unreachable = s.unreachable
+				store.mu.Unlock()
+
+				lease := leases[s.instance]
+				switch s.action {
+				case "renew":
+					if held := lease.Renew(context.Background()); held != lease.Held() {
+						t.Errorf("step %d: renew reported held %v but Held reports %v", i, held, lease.Held())
+					}
+				case "release":
+					lease.release()
+				}
+
+				if a, b := leases["a"].Held(), leases["b"].Held(); a != s.wantA || b != s.wantB {
+					t.Errorf("step %d: got a held %v and b held %v, want %v and %v", i, a, b, s.wantA, s.wantB)
+				}
+			}
+		})
+	}
+}
@@ -1,18 +1,30 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
 	"log"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
 )
 
 // Valid database API types
 const (
 	AZURE_COSMOS_DB_SQL_API = "cosmosdbsql"
+	IN_MEMORY_API           = "memory"
 )
 
 func main() {
@@ -23,30 +35,350 @@ func main() {
 	switch apiType {
 	case "cosmosdbsql":
 		log.Printf("Using Azure CosmosDB SQL API")
+	case IN_MEMORY_API:
+		log.Printf("Using in-memory database, orders will be lost when the service stops")
 	default:
 		log.Printf("Using MongoDB API")
 	}
 
-	// Initialize the database
-	orderService, err := initDatabase(apiType)
+	// Initialize the database, retrying while it comes up
+	orderService, err := initDatabaseWithRetry(apiType, getEnvInt("DB_CONNECT_MAX_RETRIES", 5), getEnvDuration("DB_CONNECT_RETRY_DELAY", 2*time.Second))
 	if err != nil {
 		log.Printf("Failed to initialize database: %s", err)
 		os.Exit(1)
 	}
 
-	router := gin.Default()
+	// Alert when too many queue messages fail to process within the window
+	poisonTracker = NewPoisonTracker(getEnvInt("POISON_MESSAGE_THRESHOLD", 10), getEnvDuration("POISON_MESSAGE_WINDOW", 5*time.Minute), nil)
+
+	// Cap how many orders are pulled from the queue and inserted per fetch
+	orderFetchMaxBatch = getEnvInt("ORDER_FETCH_MAX_BATCH", 500)
+	if orderFetchMaxBatch < 1 {
+		log.Printf("ORDER_FETCH_MAX_BATCH must be at least 1")
+		os.Exit(1)
+	}
+
+	maxRequestBodyBytes = int64(getEnvInt("MAX_REQUEST_BODY_BYTES", 1<<20))
+
+	// Responses are compact unless pretty-printing is enabled
+	responsePretty = os.Getenv("RESPONSE_PRETTY") == "true"
+
+	// Map queue messages to the order schema if configured
+	if mappingFile := os.Getenv("ORDER_MESSAGE_MAPPING_FILE"); mappingFile != "" {
+		messageMapping, err = LoadMessageMapping(mappingFile)
+		if err != nil {
+			log.Printf("Failed to load message mapping: %s", err)
+			os.Exit(1)
+		}
+		log.Printf("Mapping queue messages with %s", mappingFile)
+	}
+
+	// Accept order IDs matching a pattern instead of only numeric IDs if configured
+	orderIDPattern, err = compileOrderIDPattern(os.Getenv("ORDER_ID_PATTERN"))
+	if err != nil {
+		log.Printf("Invalid ORDER_ID_PATTERN: %s", err)
+		os.Exit(1)
+	}
+
+	// IDs generated for orders from the queue have to be accepted when they are looked up
+	orderIDPrefix = os.Getenv("ORDER_ID_PREFIX")
+	if _, err := sanitizeOrderID(newOrderID()); err != nil {
+		log.Printf("Generated order IDs must match ORDER_ID_PATTERN, set ORDER_ID_PREFIX so they do: %s", err)
+		os.Exit(1)
+	}
+
+	// Require high-value orders to be confirmed before they are complete if configured
+	confirmationThreshold = getEnvFloat("ORDER_CONFIRMATION_THRESHOLD", 0)
+	if confirmationThreshold > 0 {
+		log.Printf("Orders totaling %v or more must be confirmed before they are complete", confirmationThreshold)
+	}
+
+	// Create the indexes the service's queries rely on if configured
+	if os.Getenv("ENSURE_INDEXES") == "true" {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		err := orderService.repo.EnsureIndexes(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Failed to ensure indexes: %s", err)
+			os.Exit(1)
+		}
+	}
+
+	// Send requeued orders back to the queue orders are received from
+	if orderQueueName := os.Getenv("ORDER_QUEUE_NAME"); orderQueueName != "" {
+		orderService.orderQueue = NewRequeueOrderPublisher(orderQueueName)
+		requeueSecret, err = loadRequeueSecret()
+		if err != nil {
+			log.Printf("Failed to generate the requeue secret: %s", err)
+			os.Exit(1)
+		}
+
+		// Only Azure Service Bus dead-letters messages it can't deliver
+		orderQueueHostName := os.Getenv("AZURE_SERVICEBUS_FULLYQUALIFIEDNAMESPACE")
+		if orderQueueHostName == "" {
+			orderQueueHostName = os.Getenv("ORDER_QUEUE_HOSTNAME")
+		}
+		if orderQueueHostName != "" && os.Getenv("USE_WORKLOAD_IDENTITY_AUTH") == "true" {
+			orderService.deadLetters = NewServiceBusDeadLetterQueue(orderQueueHostName, orderQueueName)
+		}
+	}
+
+	// Notify downstream services when orders are complete if configured
+	if completedOrdersQueue := os.Getenv("COMPLETED_ORDERS_QUEUE"); completedOrdersQueue != "" {
+		log.Printf("Publishing completed orders to %s", completedOrdersQueue)
+		orderService.completedOrders = NewQueueOrderPublisher(completedOrdersQueue)
+	}
+
+	// Notify webhooks when an update changes an order's status if configured
+	if webhookURLs := os.Getenv("ORDER_WEBHOOK_URLS"); webhookURLs != "" {
+		webhooks, err := NewWebhookNotifier(webhookURLs, getEnvVar("ORDER_WEBHOOK_SECRET"), getEnvDuration("ORDER_WEBHOOK_TIMEOUT", 5*time.Second), getEnvInt("ORDER_WEBHOOK_MAX_ATTEMPTS", 3), getEnvDuration("ORDER_WEBHOOK_RETRY_DELAY", time.Second))
+		if err != nil {
+			log.Printf("Invalid webhook configuration: %s", err)
+			os.Exit(1)
+		}
+		log.Printf("Notifying %d webhooks of order status changes", len(webhooks.urls))
+		orderService.webhooks = webhooks
+	}
+
+	// The database stores the lease that decides which instance drains the queue
+	leaseStore, _ := orderService.repo.(LeaseStore)
+
+	// Encrypt the configured fields before they are stored
+	if encryptedFields := os.Getenv("ENCRYPTED_FIELDS"); encryptedFields != "" {
+		encrypter, err := NewFieldEncrypter(getEnvVar("FIELD_ENCRYPTION_KEY"))
+		if err != nil {
+			log.Printf("Invalid FIELD_ENCRYPTION_KEY: %s", err)
+			os.Exit(1)
+		}
+		encryptedRepo, err := NewEncryptedOrderRepo(orderService.repo, encrypter, strings.Split(encryptedFields, ","))
+		if err != nil {
+			log.Printf("Invalid ENCRYPTED_FIELDS: %s", err)
+			os.Exit(1)
+		}
+		log.Printf("Encrypting order fields: %s", encryptedFields)
+		orderService.repo = encryptedRepo
+	}
+
+	// Put a write-through cache in front of the database if configured
+	cacheSize := getEnvInt("ORDER_CACHE_SIZE", 0)
+	if cacheSize > 0 {
+		log.Printf("Caching up to %d orders in memory", cacheSize)
+		orderService.repo = NewCachedOrderRepo(orderService.repo, cacheSize)
+	}
+
+	// Middleware runs in the order it is registered. The request ID comes first so every later
+	// middleware can log it, and recovery wraps everything else so a panic anywhere returns JSON.
+	router := gin.New()
+	router.Use(RequestIDMiddleware())
+	router.Use(RecoveryMiddleware())
+	router.Use(gin.Logger())
 	router.Use(cors.Default())
+	if os.Getenv("SERVER_TIMING") == "true" {
+		router.Use(ServerTimingMiddleware())
+	}
 	router.Use(OrderMiddleware(orderService))
-	router.GET("/order/fetch", fetchOrders)
-	router.GET("/order/:id", getOrder)
-	router.PUT("/order", updateOrder)
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{
-			"status":  "ok",
-			"version": os.Getenv("APP_VERSION"),
-		})
+
+	// Middleware for the routes that modify orders
+	var writeMiddleware []gin.HandlerFunc
+
+	// Rate limit the routes that modify orders if configured
+	adminKey := os.Getenv("ADMIN_API_KEY")
+	rateLimitRPS := getEnvFloat("RATE_LIMIT_RPS", 0)
+	if rateLimitRPS < 0 {
+		log.Printf("RATE_LIMIT_RPS must not be negative")
+		os.Exit(1)
+	}
+	if rateLimitRPS > 0 {
+		rateLimitBurst := getEnvInt("RATE_LIMIT_BURST", 20)
+		if rateLimitBurst < 1 {
+			log.Printf("RATE_LIMIT_BURST must be at least 1")
+			os.Exit(1)
+		}
+		log.Printf("Rate limiting write endpoints to %v requests per second with a burst of %d", rateLimitRPS, rateLimitBurst)
+		writeMiddleware = append(writeMiddleware, RateLimitMiddleware(NewRateLimiter(rateLimitRPS, rateLimitBurst, nil), adminKey))
+	}
+
+	// Log the bodies of requests that modify orders when debugging
+	if os.Getenv("LOG_BODIES") == "true" {
+		logBodiesMaxBytes := getEnvInt("LOG_BODIES_MAX_BYTES", 4096)
+		log.Printf("Logging request and response bodies of write endpoints up to %d bytes, don't leave this enabled in production", logBodiesMaxBytes)
+		writeMiddleware = append(writeMiddleware, BodyLoggingMiddleware(logBodiesMaxBytes))
+	}
+
+	writeHandlers := func(handlers ...gin.HandlerFunc) []gin.HandlerFunc {
+		return append(append([]gin.HandlerFunc{}, writeMiddleware...), handlers...)
+	}
+
+	// Only report ready once the background consumer has reached the queue
+	consumerEnabled := os.Getenv("ORDER_CONSUMER_ENABLED") == "true"
+	var queueReadiness *QueueReadiness
+	if consumerEnabled {
+		queueReadiness = NewQueueReadiness(getEnvDuration("ORDER_QUEUE_READY_THRESHOLD", time.Minute), nil)
+	}
+
+	// Admin routes require the admin API key and are disabled without one
+	adminAuth := AdminAuthMiddleware(adminKey)
+
+	routes := []Route{
+		{http.MethodGet, "/order/fetch", []gin.HandlerFunc{fetchOrders}},
+		{http.MethodGet, "/order/stats", []gin.HandlerFunc{getOrderStats}},
+		{http.MethodGet, "/order/:id", []gin.HandlerFunc{getOrder}},
+		{http.MethodGet, "/orders", []gin.HandlerFunc{getOrdersByLastModifiedBy}},
+		{http.MethodPost, "/order/search", []gin.HandlerFunc{searchOrders}},
+		{http.MethodPut, "/order", writeHandlers(updateOrder)},
+		{http.MethodPost, "/order/archive", writeHandlers(adminAuth, archiveOrders)},
+		{http.MethodPost, "/order/recover", writeHandlers(adminAuth, recoverStuckOrders)},
+		{http.MethodPost, "/order/:id/confirm", writeHandlers(confirmOrder)},
+		{http.MethodPost, "/order/:id/transition", writeHandlers(transitionOrder)},
+		{http.MethodPost, "/order/:id/requeue", writeHandlers(requeueOrder)},
+		{http.MethodGet, "/deadletter", []gin.HandlerFunc{adminAuth, getDeadLetters}},
+		{http.MethodPost, "/deadletter/retry", writeHandlers(adminAuth, retryDeadLetters)},
+		{http.MethodGet, "/metrics", []gin.HandlerFunc{gin.WrapH(expvar.Handler())}},
+		{http.MethodGet, "/health", []gin.HandlerFunc{getHealth}},
+		{http.MethodGet, "/health/ready", []gin.HandlerFunc{getReadiness(queueReadiness)}},
+	}
+	if err := registerRoutes(router, routes); err != nil {
+		log.Printf("Failed to register routes: %s", err)
+		os.Exit(1)
+	}
+
+	// Drain the queue in the background if enabled
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	consumerDone := make(chan struct{})
+	close(consumerDone)
+	leaseCtx, stopLease := context.WithCancel(context.Background())
+	leaseDone := make(chan struct{})
+	close(leaseDone)
+	if consumerEnabled {
+		// Only drain the queue on the instance holding the lease if enabled, so replicas don't compete for orders
+		var lease *Lease
+		if os.Getenv("ORDER_CONSUMER_LEASE_ENABLED") == "true" {
+			if leaseStore == nil {
+				log.Printf("The order database doesn't support leases")
+				os.Exit(1)
+			}
+			leaseTTL := getEnvDuration("ORDER_CONSUMER_LEASE_TTL", 15*time.Second)
+			leaseRenewInterval := getEnvDuration("ORDER_CONSUMER_LEASE_RENEW_INTERVAL", 5*time.Second)
+			if leaseRenewInterval <= 0 || leaseRenewInterval >= leaseTTL {
+				log.Printf("ORDER_CONSUMER_LEASE_RENEW_INTERVAL must be positive and shorter than ORDER_CONSUMER_LEASE_TTL")
+				os.Exit(1)
+			}
+			lease = NewLease(leaseStore, consumerLeaseName, leaseHolderID(), leaseTTL, leaseRenewInterval, nil)
+			log.Printf("Draining the order queue only while holding lease %s, renewing it every %s for %s", consumerLeaseName, leaseRenewInterval, leaseTTL)
+			leaseDone = make(chan struct{})
+			go func() {
+				defer close(leaseDone)
+				lease.Run(leaseCtx)
+			}()
+		}
+
+		consumer := NewOrderConsumer(orderService, getOrdersFromQueue, queueReadiness, lease, getEnvDuration("ORDER_CONSUMER_IDLE_INTERVAL", time.Second), getEnvDuration("ORDER_CONSUMER_MAX_BACKOFF", 30*time.Second))
+		consumerDone = make(chan struct{})
+		go func() {
+			defer close(consumerDone)
+			consumer.Run(consumerCtx)
+		}()
+	}
+
+	addr, err := listenAddress(os.Getenv("BIND_ADDRESS"), os.Getenv("PORT"))
+	if err != nil {
+		log.Printf("Invalid listen address: %s", err)
+		os.Exit(1)
+	}
+
+	srv := &http.Server{
+		Addr:    addr,
+		Handler: router,
+	}
+
+	go func() {
+		log.Printf("Listening on %s", addr)
+		if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Failed to start server: %s", err)
+			os.Exit(1)
+		}
+	}()
+
+	// Serve the order API over gRPC as well if a port is configured
+	var grpcServer *grpc.Server
+	if grpcPort := os.Getenv("GRPC_PORT"); grpcPort != "" {
+		grpcAddr, err := listenAddress(os.Getenv("BIND_ADDRESS"), grpcPort)
+		if err != nil {
+			log.Printf("Invalid gRPC listen address: %s", err)
+			os.Exit(1)
+		}
+
+		lis, err := net.Listen("tcp", grpcAddr)
+		if err != nil {
+			log.Printf("Failed to listen for gRPC: %s", err)
+			os.Exit(1)
+		}
+
+		grpcServer = NewGRPCServer(orderService)
+		go func() {
+			log.Printf("Serving gRPC on %s", grpcAddr)
+			if err := grpcServer.Serve(lis); err != nil {
+				log.Printf("Failed to serve gRPC: %s", err)
+				os.Exit(1)
+			}
+		}()
+	}
+
+	// Wait for a termination signal and give in-flight requests time to finish
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+
+	log.Printf("Shutting down server on %s", addr)
+	stopConsumer()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	grpcStopped := make(chan struct{})
+	if grpcServer != nil {
+		go func() {
+			grpcServer.GracefulStop()
+			close(grpcStopped)
+		}()
+	} else {
+		close(grpcStopped)
+	}
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Failed to shut down server gracefully: %s", err)
+	}
+	select {
+	case <-grpcStopped:
+	case <-ctx.Done():
+		// Cut off any gRPC calls still running after the timeout. Both cases can be ready when gRPC is
+		// disabled, and select picks either.
+		if grpcServer != nil {
+			grpcServer.Stop()
+		}
+	}
+	<-consumerDone
+
+	// Release the lease only once the consumer has stopped, so another instance can take over straight away
+	stopLease()
+	<-leaseDone
+}
+
+// Reports that the service is up and its version
+func getHealth(c *gin.Context) {
+	respond(c, http.StatusOK, gin.H{
+		"status":  "ok",
+		"version": os.Getenv("APP_VERSION"),
 	})
-	router.Run(":3001")
+}
+
+// Builds the listen address from the bind address and port, defaulting to all interfaces on port 3001
+func listenAddress(bindAddress string, port string) (string, error) {
+	if port == "" {
+		port = "3001"
+	}
+	p, err := strconv.Atoi(port)
+	if err != nil || p < 1 || p > 65535 {
+		return "", fmt.Errorf("PORT must be an integer between 1 and 65535, got %q", port)
+	}
+	return net.JoinHostPort(bindAddress, strconv.Itoa(p)), nil
 }
 
 // OrderMiddleware is a middleware function that injects the order service into the request context
@@ -66,43 +398,294 @@ func fetchOrders(c *gin.Context) {
 		return
 	}
 
-	// Fetch new orders from the queue
-	newOrders, err := getOrdersFromQueue()
+	// Reject unsupported formats before any orders are pulled from the queue
+	format, ok := negotiateOrdersFormat(c)
+	if !ok {
+		return
+	}
+
+	sort, err := ParseOrderSort(c.Query("sort"))
 	if err != nil {
-		log.Printf("Failed to fetch orders from queue: %s", err)
-		c.AbortWithStatus(http.StatusInternalServerError)
+		log.Printf("Invalid sort: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
+	opts := PendingOrdersOptions{Sort: sort}
 
-	// Set all new orders to "Pending"
-	for i := range newOrders {
-		newOrders[i].Status = Pending
+	// Only return orders created within a time range if requested
+	opts.CreatedAfter, opts.CreatedBefore, err = parseCreatedRange(c)
+	if err != nil {
+		log.Printf("Invalid created range: %s", err)
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	// Fetch new orders from the queue
+	stopTiming := timePhase(c, "queue")
+	batch, err := getOrdersFromQueue()
+	stopTiming()
+	if err != nil && !errors.Is(err, ErrNoMessages) {
+		// Still return the orders already in the database while the queue is down
+		log.Printf("Failed to fetch orders from queue, returning stored orders only: %s", err)
+		queueFetchFailures.Add(1)
+		c.Header("X-Queue-Fetch-Skipped", "true")
+	}
+	var newOrders []Order
+	if batch != nil {
+		newOrders = batch.Orders
 	}
 
 	// Save new orders to MongoDB
-	if len(newOrders) > 0 {
-		err = client.repo.InsertOrders(newOrders)
-		if err != nil {
-			log.Printf("Failed to save orders to database: %s", err)
-			c.AbortWithStatus(http.StatusInternalServerError)
-			return
-		}
-		log.Printf("Inserted %d new orders into the database", len(newOrders))
+	stopTiming = timePhase(c, "db")
+	inserted, err := saveNewOrders(client, newOrders)
+	stopTiming()
+	if err != nil {
+		log.Printf("Failed to save orders to database: %s", err)
+		// Leave the orders on the queue to be fetched again
+		batch.Abandon()
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
 	}
 
+	// Only remove the orders from the queue once they are saved
+	stopTiming = timePhase(c, "queue")
+	batch.Complete()
+	stopTiming()
+
 	// Retrieve all pending orders
-	pendingOrders, err := client.repo.GetPendingOrders()
+	stopTiming = timePhase(c, "db")
+	pendingOrders, err := client.repo.GetPendingOrders(opts)
+	stopTiming()
 	if err != nil {
 		log.Printf("Failed to get pending orders from database: %s", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
+	for i := range pendingOrders {
+		pendingOrders[i].backfill()
+	}
+
 	log.Printf("Returning %d pending orders", len(pendingOrders))
-	c.IndentedJSON(http.StatusOK, pendingOrders)
+	c.Header("X-Orders-Inserted", strconv.Itoa(inserted))
+	respondOrders(c, format, pendingOrders)
+}
+
+
+
+// Gets the number of orders in each status
+func getOrderStats(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	stopTiming := timePhase(c, "db")
+	counts, err := client.repo.CountByStatus()
+	stopTiming()
+	if err != nil {
+		log.Printf("Failed to count orders by status: %s", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	// Include every status, even those without any orders
+	stats := make(map[string]int, len(Statuses))
+	for _, status := range Statuses {
+		stats[status.String()] = counts[status]
+	}
+
+	respond(c, http.StatusOK, stats)
+}
+
+// Moves completed orders older than the olderThanHours query parameter to the archive
+func archiveOrders(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	olderThanHours, err := strconv.Atoi(c.Query("olderThanHours"))
+	if err != nil || olderThanHours < 0 {
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", "olderThanHours must be a non-negative integer")
+		return
+	}
+
+	stopTiming := timePhase(c, "db")
+	archived, err := client.repo.ArchiveCompletedOrders(time.Duration(olderThanHours) * time.Hour)
+	stopTiming()
+	if err != nil {
+		log.Printf("Failed to archive completed orders after archiving %d: %s", archived, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"archived": archived})
+}
+
+// Moves orders stuck in Processing for longer than the stuckForMinutes query parameter back to Pending
+func recoverStuckOrders(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	stuckForMinutes, err := strconv.Atoi(c.Query("stuckForMinutes"))
+	if err != nil || stuckForMinutes < 1 {
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", "stuckForMinutes must be a positive integer")
+		return
+	}
+
+	change := StatusChange{Status: Pending, Actor: actorOrAnonymous(c.GetHeader("X-Actor")), Reason: "recovered"}
+
+	stopTiming := timePhase(c, "db")
+	recovered, err := client.repo.RecoverStuckOrders(time.Duration(stuckForMinutes)*time.Minute, change)
+	stopTiming()
+	if err != nil {
+		log.Printf("Failed to recover stuck orders after recovering %d: %s", recovered, err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respond(c, http.StatusOK, gin.H{"recovered": recovered})
 }
 
+// Sets new orders from the queue to "Pending", records when they were created and saves them
+func saveNewOrders(client *OrderService, newOrders []Order) (int, error) {
+	if len(newOrders) == 0 {
+		return 0, nil
+	}
+
+	// Requeued orders are already stored, so receiving them again only needs to remove them from the queue
+	var ordersToInsert []Order
+	for _, order := range newOrders {
+		if order.requeued {
+			if _, err := client.repo.GetOrderForUpdate(order.OrderID); err == nil {
+				log.Printf("Order %s was requeued and is already stored", order.OrderID)
+				continue
+			} else if !errors.Is(err, ErrOrderNotFound) {
+				return 0, err
+			}
+		}
+		ordersToInsert = append(ordersToInsert, order)
+	}
+	newOrders = ordersToInsert
+	if len(newOrders) == 0 {
+		return 0, nil
+	}
+
+	now := time.Now().UTC()
+	for i := range newOrders {
+		newOrders[i].Status = Pending
+		if newOrders[i].CreatedAt.IsZero() {
+			newOrders[i].CreatedAt = now
+		}
+		newOrders[i].UpdatedAt = now
+		newOrders[i].History = []StatusChange{{Status: Pending, At: now}}
+
+		// Always store the computed total so billing doesn't have to recompute it
+		total := newOrders[i].ComputeTotal()
+		if newOrders[i].Total != 0 && math.Abs(newOrders[i].Total-total) > totalEpsilon {
+			log.Printf("Warning: order %s has a total of %v but its items total %v, using the computed total", newOrders[i].OrderID, newOrders[i].Total, total)
+		}
+		newOrders[i].Total = total
+	}
 
+	err := client.repo.InsertOrders(newOrders)
+	if err != nil {
+		return 0, err
+	}
+	log.Printf("Inserted %d new orders into the database", len(newOrders))
+	return len(newOrders), nil
+}
+
+// Gets a page of the orders last modified by an actor
+func getOrdersByLastModifiedBy(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	actor := c.Query("lastModifiedBy")
+	if actor == "" {
+		abortWithError(c, http.StatusBadRequest, "missing_parameter", "lastModifiedBy is required")
+		return
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	stopTiming := timePhase(c, "db")
+	orders, err := client.repo.GetOrdersByLastModifiedBy(actor, page)
+	stopTiming()
+	if err != nil {
+		log.Printf("Failed to get orders from database: %s", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	respond(c, http.StatusOK, orders)
+}
+
+// Parses the createdAfter and createdBefore query parameters, returning zero times for those not given
+func parseCreatedRange(c *gin.Context) (time.Time, time.Time, error) {
+	var after, before time.Time
+	var err error
+
+	if value := c.Query("createdAfter"); value != "" {
+		after, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("createdAfter must be an RFC 3339 timestamp such as 2024-01-02T15:04:05Z, got %q", value)
+		}
+	}
+
+	if value := c.Query("createdBefore"); value != "" {
+		before, err = time.Parse(time.RFC3339, value)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("createdBefore must be an RFC 3339 timestamp such as 2024-01-02T15:04:05Z, got %q", value)
+		}
+	}
+
+	if !after.IsZero() && !before.IsZero() && !after.Before(before) {
+		return time.Time{}, time.Time{}, fmt.Errorf("createdAfter must be before createdBefore")
+	}
+
+	return after, before, nil
+}
+
+// Parses the offset and limit query parameters
+func parsePage(c *gin.Context) (Page, error) {
+	page := Page{Offset: 0, Limit: 50}
+
+	if offset := c.Query("offset"); offset != "" {
+		o, err := strconv.Atoi(offset)
+		if err != nil || o < 0 {
+			return Page{}, fmt.Errorf("offset must be a non-negative integer")
+		}
+		page.Offset = o
+	}
+
+	if limit := c.Query("limit"); limit != "" {
+		l, err := strconv.Atoi(limit)
+		if err != nil || l < 1 || l > 500 {
+			return Page{}, fmt.Errorf("limit must be an integer between 1 and 500")
+		}
+		page.Limit = l
+	}
+
+	return page, nil
+}
 
 // Gets a single order from database by order ID
 func getOrder(c *gin.Context) {
@@ -113,23 +696,28 @@ func getOrder(c *gin.Context) {
 		return
 	}
 
-	id, err := strconv.Atoi(c.Param("id"))
+	sanitizedOrderId, err := sanitizeOrderID(c.Param("id"))
 	if err != nil {
-		log.Printf("Failed to convert order id to int: %s", err)
+		log.Printf("Invalid order id: %s", err)
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	sanitizedOrderId := strconv.FormatInt(int64(id), 10)
-
-	order, err := client.repo.GetOrder(sanitizedOrderId)
+	order, err := getOrderTimed(c, client.repo, sanitizedOrderId)
 	if err != nil {
+		if errors.Is(err, ErrOrderNotFound) {
+			log.Printf("Order %s not found", sanitizedOrderId)
+			c.AbortWithStatus(http.StatusNotFound)
+			return
+		}
 		log.Printf("Failed to get order from database: %s", err)
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	c.IndentedJSON(http.StatusOK, order)
+	order.backfill()
+
+	respond(c, http.StatusOK, order)
 }
 
 // Updates the status of an order
@@ -144,45 +732,286 @@ func updateOrder(c *gin.Context) {
 
 	// Unmarshal the order from the request body
 	var order Order
-	if err := c.BindJSON(&order); err != nil {
+	if err := decodeJSONBody(c, &order); err != nil {
 		log.Printf("Failed to unmarshal order: %s", err)
-		c.AbortWithStatus(http.StatusBadRequest)
+		abortWithDecodeError(c, err)
 		return
 	}
 
-	// Validate order ID and status
-	if order.OrderID == "" {
-		log.Printf("Invalid order update request: Missing OrderID")
-		c.AbortWithStatus(http.StatusBadRequest)
+	// Record who made the change so it can be audited
+	order.LastModifiedBy = c.GetHeader("X-Actor")
+
+	update, err := client.UpdateOrder(c, order)
+	if err != nil {
+		var validationErr *ValidationError
+		var transitionErr *InvalidTransitionError
+		var partitionErr *PartitionMismatchError
+		switch {
+		case errors.As(err, &validationErr):
+			log.Printf("Invalid order update request: %s", err)
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"errors": validationErr.Errors})
+		case errors.Is(err, ErrOrderNotFound):
+			log.Printf("Order %s not found", order.OrderID)
+			c.AbortWithStatus(http.StatusNotFound)
+		case errors.Is(err, ErrExternalRefConflict):
+			log.Printf("Order %s was already completed with a different external reference", order.OrderID)
+			c.AbortWithStatus(http.StatusConflict)
+		case errors.Is(err, ErrPreconditionFailed):
+			log.Printf("Order %s was updated by another request before it could be completed", order.OrderID)
+			c.AbortWithStatus(http.StatusConflict)
+		case errors.Is(err, ErrConfirmationRequired):
+			log.Printf("Invalid order update request for order %s: %s", order.OrderID, err)
+			abortWithError(c, http.StatusConflict, "confirmation_required", fmt.Sprintf("order %s must be completed with POST /order/%s/confirm", order.OrderID, order.OrderID))
+		case errors.As(err, &transitionErr):
+			log.Printf("Invalid order update request for order %s: %s", order.OrderID, err)
+			abortWithError(c, http.StatusConflict, "invalid_transition", err.Error())
+		case errors.As(err, &partitionErr):
+			log.Printf("Failed to update order, check the partition configuration: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		default:
+			log.Printf("Failed to update order in database: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	if update.Unchanged {
+		log.Printf("Order %s was already completed with external reference %s", order.OrderID, order.ExternalRef)
+		c.Status(http.StatusOK)
+		return
+	}
+
+	if update.Status == PendingCompletion {
+		log.Printf("Order %s needs to be confirmed before it is complete", order.OrderID)
+		respond(c, http.StatusAccepted, gin.H{"orderId": order.OrderID, "status": update.Status, "confirmationRequired": true})
 		return
 	}
 
-	// Allow specific statuses for updates
-	if order.Status != Processing && order.Status != Complete {
-		log.Printf("Invalid order update request: Unsupported Status=%d", order.Status)
+	c.Status(http.StatusAccepted)
+}
+
+// Confirms the completion of an order that is awaiting confirmation
+func confirmOrder(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orderId, err := sanitizeOrderID(c.Param("id"))
+	if err != nil {
+		log.Printf("Invalid order id: %s", err)
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
 
-	// Sanitize the order ID (if required)
-	id, err := strconv.Atoi(order.OrderID)
+	// Only an order awaiting confirmation can be confirmed, so concurrent confirmations complete it once
+	stopTiming := timePhase(c, "db")
+	_, err = client.repo.TransitionOrder(orderId, []Status{PendingCompletion}, StatusChange{Status: Complete, Actor: actorOrAnonymous(c.GetHeader("X-Actor")), Reason: "confirmed"})
+	stopTiming()
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			log.Printf("Order %s not found", orderId)
+			c.AbortWithStatus(http.StatusNotFound)
+		case errors.Is(err, ErrPreconditionFailed):
+			log.Printf("Order %s is not awaiting confirmation", orderId)
+			abortWithError(c, http.StatusConflict, "invalid_transition", fmt.Sprintf("order %s is not awaiting confirmation", orderId))
+		default:
+			log.Printf("Failed to confirm order in database: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("Order %s confirmed", orderId)
+
+	if client.completedOrders != nil {
+		stopTiming = timePhase(c, "queue")
+		publishCompletedOrder(client, orderId)
+		stopTiming()
+	}
+
+	c.Status(http.StatusAccepted)
+}
+
+// Moves an order stuck in Processing back to Pending and sends it to the order queue to be processed again
+func requeueOrder(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	orderId, err := sanitizeOrderID(c.Param("id"))
 	if err != nil {
-		log.Printf("Failed to convert order id to int: %s", err)
+		log.Printf("Invalid order id: %s", err)
 		c.AbortWithStatus(http.StatusBadRequest)
 		return
 	}
-	order.OrderID = strconv.Itoa(id)
 
-	// Update the order in MongoDB
-	err = client.repo.UpdateOrder(order)
+	stopTiming := timePhase(c, "db")
+	order, err := client.repo.TransitionOrder(orderId, []Status{Processing}, StatusChange{Status: Pending, Actor: actorOrAnonymous(c.GetHeader("X-Actor")), Reason: "requeued"})
+	stopTiming()
 	if err != nil {
-		log.Printf("Failed to update order in MongoDB: %s", err)
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			log.Printf("Order %s not found", orderId)
+			c.AbortWithStatus(http.StatusNotFound)
+		case errors.Is(err, ErrPreconditionFailed):
+			log.Printf("Order %s is not processing and can't be requeued", orderId)
+			abortWithError(c, http.StatusConflict, "invalid_transition", fmt.Sprintf("order %s can only be requeued while it is processing", orderId))
+		default:
+			log.Printf("Failed to requeue order in database: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("Order %s moved back to pending", orderId)
+
+	// The order is pending even if it can't be published, so it is still returned by /order/fetch
+	if client.orderQueue != nil {
+		stopTiming = timePhase(c, "queue")
+		err = client.orderQueue.PublishOrder(order)
+		stopTiming()
+		if err != nil {
+			log.Printf("Failed to republish order %s: %s", orderId, err)
+			abortWithError(c, http.StatusBadGateway, "publish_failed", fmt.Sprintf("order %s was moved back to pending but couldn't be sent to the order queue", orderId))
+			return
+		}
+	}
+
+	respond(c, http.StatusAccepted, order)
+}
+
+// TransitionRequest is the body of an order transition
+type TransitionRequest struct {
+	Status Status `json:"status"`
+	// ExpectedStatus optionally restricts the transition to orders currently in this status
+	ExpectedStatus *Status `json:"expectedStatus,omitempty"`
+}
+
+// Atomically moves an order to a new status if it is in a status that can make the transition
+func transitionOrder(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
 		c.AbortWithStatus(http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Order %s updated successfully", order.OrderID)
-	c.Status(http.StatusAccepted)
+	orderId, err := sanitizeOrderID(c.Param("id"))
+	if err != nil {
+		log.Printf("Invalid order id: %s", err)
+		c.AbortWithStatus(http.StatusBadRequest)
+		return
+	}
+
+	var req TransitionRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		log.Printf("Failed to unmarshal transition: %s", err)
+		abortWithDecodeError(c, err)
+		return
+	}
+
+	if _, ok := statusNames[req.Status]; !ok {
+		abortWithError(c, http.StatusBadRequest, "invalid_field", fmt.Sprintf("unknown status %d", req.Status))
+		return
+	}
+
+	// Orders that need to be confirmed move to PendingCompletion, the same as with PUT /order. The total
+	// never changes once an order is stored, so it is safe to check before the transition.
+	if req.Status == Complete && confirmationThreshold > 0 {
+		existingOrder, err := getOrderForUpdateTimed(c, client.repo, orderId)
+		if err != nil {
+			if errors.Is(err, ErrOrderNotFound) {
+				log.Printf("Order %s not found", orderId)
+				c.AbortWithStatus(http.StatusNotFound)
+				return
+			}
+			log.Printf("Failed to get order from database: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+		if requiresConfirmation(existingOrder) {
+			req.Status = PendingCompletion
+		}
+	}
+
+	from := transitionSources(req.Status, req.ExpectedStatus)
+	if len(from) == 0 {
+		abortWithError(c, http.StatusConflict, "invalid_transition", fmt.Sprintf("orders can't move to %s from the expected status", req.Status))
+		return
+	}
+
+	stopTiming := timePhase(c, "db")
+	order, err := client.repo.TransitionOrder(orderId, from, StatusChange{Status: req.Status, Actor: actorOrAnonymous(c.GetHeader("X-Actor"))})
+	stopTiming()
+	if err != nil {
+		var partitionErr *PartitionMismatchError
+		switch {
+		case errors.Is(err, ErrOrderNotFound):
+			log.Printf("Order %s not found", orderId)
+			c.AbortWithStatus(http.StatusNotFound)
+		case errors.Is(err, ErrPreconditionFailed):
+			log.Printf("Order %s can't move to %s from its current status", orderId, req.Status)
+			abortWithError(c, http.StatusConflict, "precondition_failed", fmt.Sprintf("order %s can't move to %s from its current status", orderId, req.Status))
+		case errors.As(err, &partitionErr):
+			log.Printf("Failed to transition order, check the partition configuration: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		default:
+			log.Printf("Failed to transition order in database: %s", err)
+			c.AbortWithStatus(http.StatusInternalServerError)
+		}
+		return
+	}
+
+	log.Printf("Order %s moved to %s", orderId, order.Status)
+
+	if order.Status == Complete && client.completedOrders != nil {
+		stopTiming = timePhase(c, "queue")
+		publishCompletedOrder(client, orderId)
+		stopTiming()
+	}
+
+	respond(c, http.StatusOK, order)
+}
+
+// Publishes a completed order downstream. Failures are logged and counted but don't fail the update.
+func publishCompletedOrder(client *OrderService, orderId string) {
+	order, err := client.repo.GetOrderForUpdate(orderId)
+	if err != nil {
+		log.Printf("Failed to get completed order %s from database: %s", orderId, err)
+		completedOrderPublishFailures.Add(1)
+		return
+	}
+
+	err = client.completedOrders.PublishOrder(order)
+	if err != nil {
+		log.Printf("Failed to publish completed order %s: %s", orderId, err)
+		completedOrderPublishFailures.Add(1)
+		return
+	}
+
+	log.Printf("Published completed order %s", orderId)
+	completedOrdersPublished.Add(1)
+}
+
+// Sends the updated order to the webhooks in the background so the request doesn't wait for them
+func notifyStatusChange(client *OrderService, orderId string) {
+	go func() {
+		order, err := client.repo.GetOrderForUpdate(orderId)
+		if err != nil {
+			log.Printf("Failed to get updated order %s from database for webhooks: %s", orderId, err)
+			webhookDeliveryFailures.Add(int64(len(client.webhooks.urls)))
+			return
+		}
+		order.backfill()
+		client.webhooks.Notify(order)
+	}()
 }
 
 
@@ -207,8 +1036,78 @@ func getEnvVar(varName string, fallbackVarNames ...string) string {
 	return value
 }
 
+// Gets an integer environment variable or returns the default if it is not set
+func getEnvInt(varName string, defaultValue int) int {
+	value := os.Getenv(varName)
+	if value == "" {
+		return defaultValue
+	}
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("%s must be an integer: %s", varName, err)
+		os.Exit(1)
+	}
+	return i
+}
+
+// Gets a floating point environment variable or returns the default if it is not set
+func getEnvFloat(varName string, defaultValue float64) float64 {
+	value := os.Getenv(varName)
+	if value == "" {
+		return defaultValue
+	}
+	f, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("%s must be a number: %s", varName, err)
+		os.Exit(1)
+	}
+	return f
+}
+
+// Gets a duration environment variable such as "30s" or returns the default if it is not set
+func getEnvDuration(varName string, defaultValue time.Duration) time.Duration {
+	value := os.Getenv(varName)
+	if value == "" {
+		return defaultValue
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("%s must be a duration: %s", varName, err)
+		os.Exit(1)
+	}
+	return d
+}
+
+// Initializes the database, retrying with exponential backoff until it succeeds or the retries run out
+func initDatabaseWithRetry(apiType string, maxRetries int, retryDelay time.Duration) (*OrderService, error) {
+	var err error
+	for attempt := 0; ; attempt++ {
+		log.Printf("Connecting to database (attempt %d of %d)", attempt+1, maxRetries+1)
+
+		var orderService *OrderService
+		orderService, err = initDatabase(apiType)
+		if err == nil {
+			return orderService, nil
+		}
+
+		if attempt >= maxRetries {
+			break
+		}
+
+		log.Printf("Failed to connect to database: %s, retrying in %s", err, retryDelay)
+		time.Sleep(retryDelay)
+		retryDelay *= 2
+	}
+	return nil, err
+}
+
 // Initializes the database based on the API type
 func initDatabase(apiType string) (*OrderService, error) {
+	// The in-memory database doesn't need any connection settings
+	if apiType == IN_MEMORY_API {
+		return NewOrderService(NewInMemoryOrderRepo()), nil
+	}
+
 	dbURI := getEnvVar("AZURE_COSMOS_RESOURCEENDPOINT", "ORDER_DB_URI")
 	dbName := getEnvVar("ORDER_DB_NAME")
 
@@ -216,7 +1115,22 @@ func initDatabase(apiType string) (*OrderService, error) {
 	case AZURE_COSMOS_DB_SQL_API:
 		containerName := getEnvVar("ORDER_DB_CONTAINER_NAME")
 		dbPartitionKey := getEnvVar("ORDER_DB_PARTITION_KEY")
-		dbPartitionValue := getEnvVar("ORDER_DB_PARTITION_VALUE")
+		// Without a fixed partition value, orders are partitioned by their store ID
+		dbPartitionValue := os.Getenv("ORDER_DB_PARTITION_VALUE")
+		archiveContainerName := os.Getenv("ORDER_DB_ARCHIVE_CONTAINER_NAME")
+		if archiveContainerName == "" {
+			archiveContainerName = containerName + "-archive"
+		}
+		leaseContainerName := os.Getenv("ORDER_DB_LEASE_CONTAINER_NAME")
+		if leaseContainerName == "" {
+			leaseContainerName = containerName + "-leases"
+		}
+
+		// Read-only queries can relax their consistency to be served by any replica
+		readConsistency, err := parseReadConsistency(os.Getenv("ORDER_DB_READ_PREFERENCE"))
+		if err != nil {
+			return nil, err
+		}
 
 		// check if USE_WORKLOAD_IDENTITY_AUTH is set
 		useWorkloadIdentityAuth := os.Getenv("USE_WORKLOAD_IDENTITY_AUTH")
@@ -225,14 +1139,14 @@ func initDatabase(apiType string) (*OrderService, error) {
 		}
 
 		if useWorkloadIdentityAuth == "true" {
-			cosmosRepo, err := NewCosmosDBOrderRepoWithManagedIdentity(dbURI, dbName, containerName, PartitionKey{dbPartitionKey, dbPartitionValue})
+			cosmosRepo, err := NewCosmosDBOrderRepoWithManagedIdentity(dbURI, dbName, containerName, archiveContainerName, leaseContainerName, PartitionKey{dbPartitionKey, dbPartitionValue}, readConsistency)
 			if err != nil {
 				return nil, err
 			}
 			return NewOrderService(cosmosRepo), nil
 		} else {
 			dbPassword := os.Getenv("ORDER_DB_PASSWORD")
-			cosmosRepo, err := NewCosmosDBOrderRepo(dbURI, dbName, containerName, dbPassword, PartitionKey{dbPartitionKey, dbPartitionValue})
+			cosmosRepo, err := NewCosmosDBOrderRepo(dbURI, dbName, containerName, archiveContainerName, leaseContainerName, dbPassword, PartitionKey{dbPartitionKey, dbPartitionValue}, readConsistency)
 			if err != nil {
 				return nil, err
 			}
@@ -240,9 +1154,50 @@ func initDatabase(apiType string) (*OrderService, error) {
 		}
 	default:
 		collectionName := getEnvVar("ORDER_DB_COLLECTION_NAME")
+		archiveCollectionName := os.Getenv("ORDER_DB_ARCHIVE_COLLECTION_NAME")
+		if archiveCollectionName == "" {
+			archiveCollectionName = collectionName + "_archive"
+		}
+		leaseCollectionName := os.Getenv("ORDER_DB_LEASE_COLLECTION_NAME")
+		if leaseCollectionName == "" {
+			leaseCollectionName = collectionName + "_leases"
+		}
+
+		// Defaults match the mongo driver's pool settings
+		maxPoolSize := getEnvInt("ORDER_DB_MAX_POOL_SIZE", 100)
+		minPoolSize := getEnvInt("ORDER_DB_MIN_POOL_SIZE", 0)
+		if maxPoolSize < 0 || minPoolSize < 0 {
+			log.Printf("ORDER_DB_MAX_POOL_SIZE and ORDER_DB_MIN_POOL_SIZE must not be negative")
+			os.Exit(1)
+		}
+		// A max pool size of 0 means the pool is unlimited
+		if maxPoolSize > 0 && minPoolSize > maxPoolSize {
+			log.Printf("ORDER_DB_MIN_POOL_SIZE must not be greater than ORDER_DB_MAX_POOL_SIZE")
+			os.Exit(1)
+		}
+		pool := MongoPoolOptions{
+			MaxPoolSize: uint64(maxPoolSize),
+			MinPoolSize: uint64(minPoolSize),
+			MaxIdleTime: time.Duration(getEnvInt("ORDER_DB_MAX_IDLE_TIME_MS", 0)) * time.Millisecond,
+		}
+
+		// Read-only queries can be served by secondaries, writes always go to the primary
+		readPreference, err := parseReadPreference(os.Getenv("ORDER_DB_READ_PREFERENCE"))
+		if err != nil {
+			return nil, err
+		}
+
+		if os.Getenv("USE_WORKLOAD_IDENTITY_AUTH") == "true" {
+			mongoRepo, err := NewMongoDBOrderRepoWithManagedIdentity(dbURI, dbName, collectionName, archiveCollectionName, leaseCollectionName, pool, readPreference)
+			if err != nil {
+				return nil, err
+			}
+			return NewOrderService(mongoRepo), nil
+		}
+
 		dbUsername := os.Getenv("ORDER_DB_USERNAME")
 		dbPassword := os.Getenv("ORDER_DB_PASSWORD")
-		mongoRepo, err := NewMongoDBOrderRepo(dbURI, dbName, collectionName, dbUsername, dbPassword)
+		mongoRepo, err := NewMongoDBOrderRepo(dbURI, dbName, collectionName, archiveCollectionName, leaseCollectionName, dbUsername, dbPassword, pool, readPreference)
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Serves the order handlers from a service without the middleware that needs configuration
+func newTestRouter(service *OrderService) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Use(OrderMiddleware(service))
+	router.GET("/order/:id", getOrder)
+	router.PUT("/order", updateOrder)
+	return router
+}
+
+func serveJSON(router http.Handler, method string, path string, body any) *httptest.ResponseRecorder {
+	var data []byte
+	if body != nil {
+		data, _ = json.Marshal(body)
+	}
+	req := httptest.NewRequest(method, path, bytes.NewReader(data))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// staleReadRepo returns the first reads of an order for an update as pending, as if another request completed
+// it in between
+type staleReadRepo struct {
+	*InMemoryOrderRepo
+	staleReads int
+}
+
+func (r *staleReadRepo) GetOrderForUpdate(id string) (Order, error) {
+	order, err := r.InMemoryOrderRepo.GetOrderForUpdate(id)
+	if err == nil && r.staleReads > 0 {
+		r.staleReads--
+		order.Status = Pending
+		order.ExternalRef = ""
+	}
+	return order, err
+}
+
+func TestUpdateOrderIdempotentCompletion(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      Status
+		externalRef string
+		staleReads  int
+		ref         string
+		wantCode    int
+		wantRef     string
+	}{
+		{name: "completes a pending order", status: Pending, ref: "inv-1", wantCode: http.StatusAccepted, wantRef: "inv-1"},
+		{name: "same reference again is a no-op", status: Complete, externalRef: "inv-1", ref: "inv-1", wantCode: http.StatusOK, wantRef: "inv-1"},
+		{name: "different reference conflicts", status: Complete, externalRef: "inv-1", ref: "inv-2", wantCode: http.StatusConflict, wantRef: "inv-1"},
+		{name: "completed in between with the same reference", status: Complete, externalRef: "inv-1", staleReads: 1, ref: "inv-1", wantCode: http.StatusOK, wantRef: "inv-1"},
+		{name: "completed in between with a different reference", status: Complete, externalRef: "inv-1", staleReads: 1, ref: "inv-2", wantCode: http.StatusConflict, wantRef: "inv-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &staleReadRepo{InMemoryOrderRepo: NewInMemoryOrderRepo(), staleReads: tt.staleReads}
+			repo.InsertOrders([]Order{{OrderID: "1", Status: tt.status, ExternalRef: tt.externalRef}})
+			router := newTestRouter(NewOrderService(repo))
+
+			w := serveJSON(router, http.MethodPut, "/order", gin.H{"orderId": "1", "status": "complete", "externalRef": tt.ref})
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+
+			order, _ := repo.InMemoryOrderRepo.GetOrder("1")
+			if order.Status != Complete || order.ExternalRef != tt.wantRef {
+				t.Errorf("got order %s with reference %q, want complete with %q", order.Status, order.ExternalRef, tt.wantRef)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderConcurrentCompletion(t *testing.T) {
+	repo := NewInMemoryOrderRepo()
+	repo.InsertOrders([]Order{{OrderID: "1", Status: Processing}})
+	router := newTestRouter(NewOrderService(repo))
+
+	const callers = 8
+	codes := make(chan int, callers)
+	var wg sync.WaitGroup
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(ref string) {
+			defer wg.Done()
+			codes <- serveJSON(router, http.MethodPut, "/order", gin.H{"orderId": "1", "status": "complete", "externalRef": ref}).Code
+		}(fmt.Sprintf("inv-%d", i))
+	}
+	wg.Wait()
+	close(codes)
+
+	counts := make(map[int]int)
+	for code := range codes {
+		counts[code]++
+	}
+	if counts[http.StatusAccepted] != 1 || counts[http.StatusConflict] != callers-1 {
+		t.Errorf("got responses %v, want one %d and the rest %d", counts, http.StatusAccepted, http.StatusConflict)
+	}
+
+	order, _ := repo.GetOrder("1")
+	if len(order.History) != 1 {
+		t.Errorf("got %d status changes, want the order completed once", len(order.History))
+	}
+}
+
+// failingRepo fails reads and updates of orders with an error
+type failingRepo struct {
+	*InMemoryOrderRepo
+	err error
+}
+
+func (r *failingRepo) GetOrder(id string) (Order, error) {
+	return Order{}, r.err
+}
+
+func (r *failingRepo) GetOrderForUpdate(id string) (Order, error) {
+	return Order{}, r.err
+}
+
+func (r *failingRepo) UpdateOrder(order Order) error {
+	return r.err
+}
+
+func (r *failingRepo) TransitionOrder(id string, from []Status, change StatusChange) (Order, error) {
+	return Order{}, r.err
+}
+
+func TestGetOrderErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		id       string
+		err      error
+		wantCode int
+	}{
+		{name: "found", id: "1", wantCode: http.StatusOK},
+		{name: "invalid id", id: "abc", wantCode: http.StatusBadRequest},
+		{name: "not found", id: "2", wantCode: http.StatusNotFound},
+		{name: "wrapped not found", id: "2", err: fmt.Errorf("lookup failed: %w", ErrOrderNotFound), wantCode: http.StatusNotFound},
+		{name: "database error", id: "1", err: errors.New("connection reset"), wantCode: http.StatusInternalServerError},
+		{name: "partition mismatch", id: "1", err: &PartitionMismatchError{OrderID: "1", PartitionValue: "a", PartitionValues: []string{"b"}}, wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			memory := NewInMemoryOrderRepo()
+			memory.InsertOrders([]Order{{OrderID: "1", Status: Pending}})
+			var repo OrderRepo = memory
+			if tt.err != nil {
+				repo = &failingRepo{InMemoryOrderRepo: memory, err: tt.err}
+			}
+
+			w := serveJSON(newTestRouter(NewOrderService(repo)), http.MethodGet, "/order/"+tt.id, nil)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderErrors(t *testing.T) {
+	mismatch := &PartitionMismatchError{OrderID: "1", PartitionValue: "a", PartitionValues: []string{"b"}}
+
+	tests := []struct {
+		name string
+		// body of the update, completing with a reference reads the order first
+		body     gin.H
+		err      error
+		wantCode int
+	}{
+		{name: "not found", body: gin.H{"orderId": "1", "status": "processing"}, err: ErrOrderNotFound, wantCode: http.StatusNotFound},
+		{name: "not found on read", body: gin.H{"orderId": "1", "status": "complete", "externalRef": "inv-1"}, err: ErrOrderNotFound, wantCode: http.StatusNotFound},
+		{name: "partition mismatch", body: gin.H{"orderId": "1", "status": "processing"}, err: mismatch, wantCode: http.StatusInternalServerError},
+		{name: "partition mismatch on read", body: gin.H{"orderId": "1", "status": "complete", "externalRef": "inv-1"}, err: mismatch, wantCode: http.StatusInternalServerError},
+		{name: "database error", body: gin.H{"orderId": "1", "status": "processing"}, err: errors.New("connection reset"), wantCode: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &failingRepo{InMemoryOrderRepo: NewInMemoryOrderRepo(), err: tt.err}
+
+			w := serveJSON(newTestRouter(NewOrderService(repo)), http.MethodPut, "/order", tt.body)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
+
+func TestSaveNewOrdersReportsInserted(t *testing.T) {
+	tests := []struct {
+		name   string
+		orders []Order
+		want   int
+	}{
+		{name: "no orders", want: 0},
+		{name: "new orders", orders: []Order{{OrderID: "2"}, {OrderID: "3"}}, want: 2},
+		{name: "requeued order already stored", orders: []Order{{OrderID: "1", requeued: true}, {OrderID: "2"}}, want: 1},
+		{name: "requeued order no longer stored", orders: []Order{{OrderID: "4", requeued: true}}, want: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			repo.InsertOrders([]Order{{OrderID: "1", Status: Pending}})
+
+			inserted, err := saveNewOrders(NewOrderService(repo), tt.orders)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inserted != tt.want {
+				t.Errorf("got %d inserted, want %d", inserted, tt.want)
+			}
+		})
+	}
+}
+
+// laggingReplicaRepo doesn't find any order through the read preference, as if the replicas hadn't caught up yet
+type laggingReplicaRepo struct {
+	*InMemoryOrderRepo
+}
+
+func (r *laggingReplicaRepo) GetOrder(id string) (Order, error) {
+	return Order{}, ErrOrderNotFound
+}
+
+func TestUpdatesReadFromPrimary(t *testing.T) {
+	tests := []struct {
+		name     string
+		cached   bool
+		ref      string
+		wantCode int
+	}{
+		{name: "same reference again is a no-op", ref: "inv-1", wantCode: http.StatusOK},
+		{name: "different reference conflicts", ref: "inv-2", wantCode: http.StatusConflict},
+		{name: "cached different reference conflicts", cached: true, ref: "inv-2", wantCode: http.StatusConflict},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var repo OrderRepo = &laggingReplicaRepo{NewInMemoryOrderRepo()}
+			if tt.cached {
+				repo = NewCachedOrderRepo(repo, 10)
+			}
+			repo.InsertOrders([]Order{{OrderID: "1", Status: Complete, ExternalRef: "inv-1"}})
+			service := NewOrderService(repo)
+
+			w := serveJSON(newTestRouter(service), http.MethodPut, "/order", gin.H{"orderId": "1", "status": "complete", "externalRef": tt.ref})
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+
+			// a requeued order that the replicas don't have yet is still recognized as stored
+			inserted, err := saveNewOrders(service, []Order{{OrderID: "1", requeued: true}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if inserted != 0 {
+				t.Errorf("got %d inserted, want the requeued order recognized as stored", inserted)
+			}
+		})
+	}
+}
+
+func TestUpdateOrderRecordsActor(t *testing.T) {
+	tests := []struct {
+		name  string
+		actor string
+		want  string
+	}{
+		{name: "actor header", actor: "kitchen", want: "kitchen"},
+		{name: "no actor header", want: anonymousActor},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			repo.InsertOrders([]Order{{OrderID: "1", Status: Pending, LastModifiedBy: "previous"}})
+			router := newTestRouter(NewOrderService(repo))
+
+			data, _ := json.Marshal(gin.H{"orderId": "1", "status": "processing"})
+			req := httptest.NewRequest(http.MethodPut, "/order", bytes.NewReader(data))
+			if tt.actor != "" {
+				req.Header.Set("X-Actor", tt.actor)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("got status %d, want %d", w.Code, http.StatusAccepted)
+			}
+
+			order, _ := repo.GetOrder("1")
+			if order.LastModifiedBy != tt.want || order.History[len(order.History)-1].Actor != tt.want {
+				t.Errorf("got lastModifiedBy %q and history actor %q, want %q", order.LastModifiedBy, order.History[len(order.History)-1].Actor, tt.want)
+			}
+		})
+	}
+}
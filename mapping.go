@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// Mapping applied to queue messages before they are unmarshaled into an order, or nil for none
+var messageMapping *MessageMapping
+
+// MessageMapping adapts queue messages from producers that use a different schema than Order.
+// Fields are renamed first, then computed fields are added and finally defaults fill in any
+// fields that are still missing.
+type MessageMapping struct {
+	// Rename maps message field names to order field names
+	Rename map[string]string `json:"rename"`
+	// ItemRename maps field names of each item to item field names
+	ItemRename map[string]string `json:"itemRename"`
+	// Computed fields are built from other fields of the message
+	Computed map[string]ComputedField `json:"computed"`
+	// Defaults are used for fields missing from the message
+	Defaults map[string]any `json:"defaults"`
+}
+
+// ComputedField joins the values of other message fields
+type ComputedField struct {
+	Join      []string `json:"join"`
+	Separator string   `json:"separator"`
+}
+
+// Loads a mapping file, failing if it is malformed or refers to fields that don't exist
+func LoadMessageMapping(path string) (*MessageMapping, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var mapping MessageMapping
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&mapping); err != nil {
+		return nil, fmt.Errorf("failed to parse mapping file %s: %w", path, err)
+	}
+
+	if err := mapping.validate(); err != nil {
+		return nil, fmt.Errorf("invalid mapping file %s: %w", path, err)
+	}
+	return &mapping, nil
+}
+
+func (m *MessageMapping) validate() error {
+	orderFields := jsonFieldNames(reflect.TypeOf(Order{}))
+	itemFields := jsonFieldNames(reflect.TypeOf(Item{}))
+
+	var errs []error
+	for from, to := range m.Rename {
+		if !orderFields[to] {
+			errs = append(errs, fmt.Errorf("rename of %s targets unknown order field %s", from, to))
+		}
+	}
+	for from, to := range m.ItemRename {
+		if !itemFields[to] {
+			errs = append(errs, fmt.Errorf("item rename of %s targets unknown item field %s", from, to))
+		}
+	}
+	for field, computed := range m.Computed {
+		if !orderFields[field] {
+			errs = append(errs, fmt.Errorf("computed field %s is not an order field", field))
+		}
+		if len(computed.Join) == 0 {
+			errs = append(errs, fmt.Errorf("computed field %s has no fields to join", field))
+		}
+	}
+	for field := range m.Defaults {
+		if !orderFields[field] {
+			errs = append(errs, fmt.Errorf("default for %s is not an order field", field))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Apply transforms a message into the schema of an Order
+func (m *MessageMapping) Apply(data []byte) ([]byte, error) {
+	var message map[string]any
+	if err := json.Unmarshal(data, &message); err != nil {
+		return nil, err
+	}
+
+	renameFields(message, m.Rename)
+	if items, ok := message["items"].([]any); ok {
+		for _, item := range items {
+			if fields, ok := item.(map[string]any); ok {
+				renameFields(fields, m.ItemRename)
+			}
+		}
+	}
+
+	for field, computed := range m.Computed {
+		values := make([]string, 0, len(computed.Join))
+		for _, from := range computed.Join {
+			if value, ok := message[from]; ok && value != nil {
+				values = append(values, fmt.Sprint(value))
+			}
+		}
+		message[field] = strings.Join(values, computed.Separator)
+	}
+
+	for field, value := range m.Defaults {
+		if _, ok := message[field]; !ok {
+			message[field] = value
+		}
+	}
+
+	return json.Marshal(message)
+}
+
+func renameFields(fields map[string]any, renames map[string]string) {
+	for from, to := range renames {
+		if value, ok := fields[from]; ok {
+			delete(fields, from)
+			fields[to] = value
+		}
+	}
+}
+
+// Gets the JSON names of the fields of a struct type
+func jsonFieldNames(t reflect.Type) map[string]bool {
+	names := make(map[string]bool)
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
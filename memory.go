@@ -0,0 +1,258 @@
+package main
+
+import (
+	"context"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// InMemoryOrderRepo keeps orders in memory for local development and tests. Orders are lost when the service stops.
+type InMemoryOrderRepo struct {
+	mu       sync.RWMutex
+	orders   map[string]Order
+	archive  map[string]Order
+	inserted []string
+	leases   map[string]memoryLease
+}
+
+type memoryLease struct {
+	holder    string
+	expiresAt time.Time
+}
+
+func NewInMemoryOrderRepo() *InMemoryOrderRepo {
+	return &InMemoryOrderRepo{
+		orders:  make(map[string]Order),
+		archive: make(map[string]Order),
+		leases:  make(map[string]memoryLease),
+	}
+}
+
+func (r *InMemoryOrderRepo) GetPendingOrders(opts PendingOrdersOptions) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var orders []Order
+	for _, id := range r.inserted {
+		if order, ok := r.orders[id]; ok && order.Status == Pending && opts.inCreatedRange(order) {
+			orders = append(orders, cloneOrder(order))
+		}
+	}
+	sortOrders(orders, opts.Sort)
+	return orders, nil
+}
+
+func (r *InMemoryOrderRepo) GetOrder(id string) (Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if order, ok := r.orders[id]; ok {
+		return cloneOrder(order), nil
+	}
+	if order, ok := r.archive[id]; ok {
+		return cloneOrder(order), nil
+	}
+	return Order{}, ErrOrderNotFound
+}
+
+func (r *InMemoryOrderRepo) GetOrderForUpdate(id string) (Order, error) {
+	return r.GetOrder(id)
+}
+
+func (r *InMemoryOrderRepo) InsertOrders(orders []Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, order := range orders {
+		if _, ok := r.orders[order.OrderID]; !ok {
+			r.inserted = append(r.inserted, order.OrderID)
+		}
+		r.orders[order.OrderID] = cloneOrder(order)
+	}
+
+	log.Printf("Inserted %v orders into memory", len(orders))
+	return nil
+}
+
+func (r *InMemoryOrderRepo) UpdateOrder(order Order) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.orders[order.OrderID]
+	if !ok {
+		return ErrOrderNotFound
+	}
+
+	existing = cloneOrder(existing)
+	existing.Status = order.Status
+	existing.UpdatedAt = order.UpdatedAt
+	if existing.UpdatedAt.IsZero() {
+		existing.UpdatedAt = time.Now().UTC()
+	}
+	existing.History = append(existing.History, StatusChange{Status: order.Status, At: existing.UpdatedAt, Actor: order.LastModifiedBy})
+	if order.ExternalRef != "" {
+		existing.ExternalRef = order.ExternalRef
+	}
+	existing.LastModifiedBy = order.LastModifiedBy
+	r.orders[order.OrderID] = existing
+	return nil
+}
+
+func (r *InMemoryOrderRepo) TransitionOrder(id string, from []Status, change StatusChange) (Order, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	existing, ok := r.orders[id]
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	if !slices.Contains(from, existing.Status) {
+		return Order{}, ErrPreconditionFailed
+	}
+
+	if change.At.IsZero() {
+		change.At = time.Now().UTC()
+	}
+
+	existing = cloneOrder(existing)
+	existing.Status = change.Status
+	existing.UpdatedAt = change.At
+	existing.History = append(existing.History, change)
+	existing.LastModifiedBy = change.Actor
+	if change.ExternalRef != "" {
+		existing.ExternalRef = change.ExternalRef
+	}
+	r.orders[id] = existing
+	return cloneOrder(existing), nil
+}
+
+func (r *InMemoryOrderRepo) CountByStatus() (map[Status]int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	counts := make(map[Status]int)
+	for _, order := range r.orders {
+		counts[order.Status]++
+	}
+	return counts, nil
+}
+
+func (r *InMemoryOrderRepo) GetOrdersByLastModifiedBy(actor string, page Page) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	orders := []Order{}
+	for _, id := range r.inserted {
+		if order, ok := r.orders[id]; ok && order.LastModifiedBy == actor {
+			orders = append(orders, cloneOrder(order))
+		}
+	}
+	sortOrders(orders, OrderSort{Field: SortByCreatedAt})
+
+	start := min(page.Offset, len(orders))
+	end := min(start+page.Limit, len(orders))
+	return orders[start:end], nil
+}
+
+func (r *InMemoryOrderRepo) SearchOrders(search OrderSearch, page Page) ([]Order, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	orders := []Order{}
+	for _, id := range r.inserted {
+		if order, ok := r.orders[id]; ok && search.matches(order) {
+			orders = append(orders, cloneOrder(order))
+		}
+	}
+	sortOrders(orders, OrderSort{Field: SortByCreatedAt})
+
+	start := min(page.Offset, len(orders))
+	end := min(start+page.Limit, len(orders))
+	return orders[start:end], nil
+}
+
+func (r *InMemoryOrderRepo) ArchiveCompletedOrders(olderThan time.Duration) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// orders are archived by when they were completed
+	cutoff := time.Now().UTC().Add(-olderThan)
+	archived := 0
+	for id, order := range r.orders {
+		completedAt := order.UpdatedAt
+		if completedAt.IsZero() {
+			completedAt = order.CreatedAt
+		}
+		if order.Status == Complete && completedAt.Before(cutoff) {
+			r.archive[id] = order
+			delete(r.orders, id)
+			archived++
+		}
+	}
+
+	log.Printf("Archived %v orders", archived)
+	return archived, nil
+}
+
+func (r *InMemoryOrderRepo) RecoverStuckOrders(stuckFor time.Duration, change StatusChange) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if change.At.IsZero() {
+		change.At = time.Now().UTC()
+	}
+	cutoff := change.At.Add(-stuckFor)
+
+	recovered := 0
+	for id, order := range r.orders {
+		order.backfill()
+		if order.Status != Processing || !order.UpdatedAt.Before(cutoff) {
+			continue
+		}
+
+		order = cloneOrder(order)
+		order.Status = change.Status
+		order.UpdatedAt = change.At
+		order.History = append(order.History, change)
+		order.LastModifiedBy = change.Actor
+		r.orders[id] = order
+		recovered++
+	}
+
+	log.Printf("Recovered %v stuck orders", recovered)
+	return recovered, nil
+}
+
+// AcquireLease only coordinates consumers sharing this repo, since leases in memory aren't visible to other instances
+func (r *InMemoryOrderRepo) AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	if lease, ok := r.leases[name]; ok && lease.holder != holder && lease.expiresAt.After(now) {
+		return false, nil
+	}
+	r.leases[name] = memoryLease{holder, now.Add(ttl)}
+	return true, nil
+}
+
+func (r *InMemoryOrderRepo) ReleaseLease(ctx context.Context, name string, holder string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if lease, ok := r.leases[name]; ok && lease.holder == holder {
+		delete(r.leases, name)
+	}
+	return nil
+}
+
+func (r *InMemoryOrderRepo) Ping(ctx context.Context) error {
+	return nil
+}
+
+// EnsureIndexes does nothing, orders in memory are found by ID and filtered without indexes
+func (r *InMemoryOrderRepo) EnsureIndexes(ctx context.Context) error {
+	return nil
+}
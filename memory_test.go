@@ -0,0 +1,157 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newMemoryTestRepo stores a pending, a processing and a complete order
+func newMemoryTestRepo(t *testing.T) *InMemoryOrderRepo {
+	t.Helper()
+	repo := NewInMemoryOrderRepo()
+	err := repo.InsertOrders([]Order{
+		{OrderID: "1", Status: Pending, Items: []Item{{Product: 1, Quantity: 1, Price: 1}}},
+		{OrderID: "2", Status: Processing, Items: []Item{{Product: 1, Quantity: 1, Price: 1}}},
+		{OrderID: "3", Status: Complete, Items: []Item{{Product: 1, Quantity: 1, Price: 1}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestInMemoryOrderRepoGetOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		wantStatus Status
+		wantErr    error
+	}{
+		{name: "stored order", id: "2", wantStatus: Processing},
+		{name: "unknown order", id: "4", wantErr: ErrOrderNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, err := newMemoryTestRepo(t).GetOrder(tt.id)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err == nil && order.Status != tt.wantStatus {
+				t.Errorf("got order %s, want %s", order.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestInMemoryOrderRepoGetPendingOrders(t *testing.T) {
+	repo := newMemoryTestRepo(t)
+
+	orders, err := repo.GetPendingOrders(PendingOrdersOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(orders) != 1 || orders[0].OrderID != "1" {
+		t.Fatalf("got pending orders %v, want only order 1", orders)
+	}
+
+	// changing a returned order mustn't change the stored one
+	orders[0].Items[0].Quantity = 5
+	order, _ := repo.GetOrder("1")
+	if order.Items[0].Quantity != 1 {
+		t.Errorf("got quantity %d after changing a returned order, want 1", order.Items[0].Quantity)
+	}
+}
+
+func TestInMemoryOrderRepoUpdateOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		order   Order
+		wantErr error
+	}{
+		{name: "stored order", order: Order{OrderID: "1", Status: Processing, LastModifiedBy: "alice"}},
+		{name: "unknown order", order: Order{OrderID: "4", Status: Processing}, wantErr: ErrOrderNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newMemoryTestRepo(t)
+			err := repo.UpdateOrder(tt.order)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+
+			order, _ := repo.GetOrder(tt.order.OrderID)
+			if order.Status != tt.order.Status || order.LastModifiedBy != tt.order.LastModifiedBy {
+				t.Errorf("got order %s modified by %q, want %s modified by %q", order.Status, order.LastModifiedBy, tt.order.Status, tt.order.LastModifiedBy)
+			}
+			if order.UpdatedAt.IsZero() || len(order.History) != 1 {
+				t.Errorf("got updated at %s with %d history entries, want the update recorded", order.UpdatedAt, len(order.History))
+			}
+		})
+	}
+}
+
+func TestInMemoryOrderRepoTransitionOrder(t *testing.T) {
+	tests := []struct {
+		name       string
+		id         string
+		from       []Status
+		wantStatus Status
+		wantErr    error
+	}{
+		{name: "from an allowed status", id: "1", from: []Status{Pending}, wantStatus: Processing},
+		{name: "from another status", id: "3", from: []Status{Pending}, wantStatus: Complete, wantErr: ErrPreconditionFailed},
+		{name: "unknown order", id: "4", from: []Status{Pending}, wantErr: ErrOrderNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := newMemoryTestRepo(t)
+			_, err := repo.TransitionOrder(tt.id, tt.from, StatusChange{Status: Processing, Actor: "alice"})
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("got error %v, want %v", err, tt.wantErr)
+			}
+			if order, err := repo.GetOrder(tt.id); err == nil && order.Status != tt.wantStatus {
+				t.Errorf("got order %s, want %s", order.Status, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestInMemoryOrderRepoArchiveCompletedOrders(t *testing.T) {
+	now := time.Now().UTC()
+
+	tests := []struct {
+		name         string
+		order        Order
+		wantArchived int
+	}{
+		{name: "completed long ago", order: Order{OrderID: "1", Status: Complete, CreatedAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-48 * time.Hour)}, wantArchived: 1},
+		{name: "old order completed recently", order: Order{OrderID: "1", Status: Complete, CreatedAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-time.Minute)}},
+		{name: "stored before updates were tracked", order: Order{OrderID: "1", Status: Complete, CreatedAt: now.Add(-48 * time.Hour)}, wantArchived: 1},
+		{name: "not complete", order: Order{OrderID: "1", Status: Processing, CreatedAt: now.Add(-48 * time.Hour), UpdatedAt: now.Add(-48 * time.Hour)}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := NewInMemoryOrderRepo()
+			repo.orders[tt.order.OrderID] = tt.order
+
+			archived, err := repo.ArchiveCompletedOrders(24 * time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if archived != tt.wantArchived {
+				t.Errorf("got %d archived, want %d", archived, tt.wantArchived)
+			}
+			if _, err := repo.GetOrder(tt.order.OrderID); err != nil {
+				t.Errorf("order can't be retrieved after archiving: %s", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+	"sync"
+)
+
+// Request units charged by Cosmos DB per order, labeled by operation
+var cosmosRequestUnits = expvar.NewMap("cosmos_request_units_per_order")
+
+// Completed orders published downstream and publishes that failed
+var (
+	completedOrdersPublished      = expvar.NewInt("completed_orders_published_total")
+	completedOrderPublishFailures = expvar.NewInt("completed_order_publish_failures_total")
+)
+
+// Webhook deliveries that succeeded and deliveries that failed after every attempt
+var (
+	webhookDeliveries       = expvar.NewInt("webhook_deliveries_total")
+	webhookDeliveryFailures = expvar.NewInt("webhook_delivery_failures_total")
+)
+
+// Order fetches that skipped the queue because it couldn't be reached
+var queueFetchFailures = expvar.NewInt("queue_fetch_failures_total")
+
+// Upper bounds of the request unit histogram buckets
+var requestUnitBuckets = []float64{1, 2, 5, 10, 20, 50, 100}
+
+// Histogram counts observations into cumulative buckets and publishes them through expvar
+type Histogram struct {
+	mu      sync.Mutex
+	bounds  []float64
+	buckets []uint64
+	count   uint64
+	sum     float64
+}
+
+func NewHistogram(bounds []float64) *Histogram {
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)),
+	}
+}
+
+func (h *Histogram) Observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.count++
+	h.sum += value
+	for i, bound := range h.bounds {
+		if value <= bound {
+			h.buckets[i]++
+		}
+	}
+}
+
+// String renders the histogram as JSON so it can be published as an expvar.Var
+func (h *Histogram) String() string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	buckets := make(map[string]uint64, len(h.bounds))
+	for i, bound := range h.bounds {
+		b, _ := json.Marshal(bound)
+		buckets[string(b)] = h.buckets[i]
+	}
+
+	b, _ := json.Marshal(struct {
+		Buckets map[string]uint64 `json:"buckets"`
+		Count   uint64            `json:"count"`
+		Sum     float64           `json:"sum"`
+	}{buckets, h.count, h.sum})
+	return string(b)
+}
+
+// Guards creation of labeled histograms
+var histogramMu sync.Mutex
+
+// Records an observation in the histogram stored under label, creating it on first use
+func observeHistogram(m *expvar.Map, label string, bounds []float64, value float64) {
+	histogramMu.Lock()
+	h, ok := m.Get(label).(*Histogram)
+	if !ok {
+		h = NewHistogram(bounds)
+		m.Set(label, h)
+	}
+	histogramMu.Unlock()
+
+	h.Observe(value)
+}
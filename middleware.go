@@ -0,0 +1,60 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"runtime/debug"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gofrs/uuid"
+)
+
+// RequestIDMiddleware tags each request with the X-Request-ID header, generating one if the client didn't send it
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		requestID := c.GetHeader("X-Request-ID")
+		if requestID == "" {
+			id, err := uuid.NewV4()
+			if err != nil {
+				log.Printf("Failed to generate request id: %s", err)
+			} else {
+				requestID = id.String()
+			}
+		}
+		c.Set("requestId", requestID)
+		c.Header("X-Request-ID", requestID)
+		c.Next()
+	}
+}
+
+// RecoveryMiddleware recovers from panics in later handlers, logging the stack trace and
+// returning the standard JSON error body
+func RecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Printf("Recovered from panic in request %s: %v\n%s", c.GetString("requestId"), r, debug.Stack())
+				abortWithError(c, http.StatusInternalServerError, "panic", "internal server error")
+			}
+		}()
+		c.Next()
+	}
+}
+
+// AdminAuthMiddleware only lets requests through when their X-API-Key header matches the admin
+// key. Admin routes are disabled entirely when no admin key is configured.
+func AdminAuthMiddleware(adminKey string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if adminKey == "" {
+			abortWithError(c, http.StatusForbidden, "admin_disabled", "admin endpoints are disabled")
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("X-API-Key")), []byte(adminKey)) != 1 {
+			log.Printf("Rejected admin request %s from %s", c.GetString("requestId"), c.ClientIP())
+			abortWithError(c, http.StatusForbidden, "forbidden", "a valid admin API key is required")
+			return
+		}
+		c.Next()
+	}
+}
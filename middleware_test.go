@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRecoveryMiddleware(t *testing.T) {
+	tests := []struct {
+		name     string
+		handler  gin.HandlerFunc
+		wantCode int
+		wantErr  string
+	}{
+		{name: "passes through without a panic", handler: func(c *gin.Context) { c.Status(http.StatusNoContent) }, wantCode: http.StatusNoContent},
+		{name: "recovers from a panic with a string", handler: func(c *gin.Context) { panic("boom") }, wantCode: http.StatusInternalServerError, wantErr: "panic"},
+		{name: "recovers from a panic with an error", handler: func(c *gin.Context) { panic(errors.New("boom")) }, wantCode: http.StatusInternalServerError, wantErr: "panic"},
+		{name: "recovers from a nil map write", handler: func(c *gin.Context) {
+			var m map[string]int
+			m["boom"] = 1
+		}, wantCode: http.StatusInternalServerError, wantErr: "panic"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(RequestIDMiddleware())
+			router.Use(RecoveryMiddleware())
+			router.GET("/", tt.handler)
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("X-Request-ID", "req-1")
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+			if got := w.Header().Get("X-Request-ID"); got != "req-1" {
+				t.Errorf("got request id %q, want %q", got, "req-1")
+			}
+			if tt.wantErr == "" {
+				return
+			}
+
+			var body struct {
+				Error APIError `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatalf("response body isn't JSON: %s", err)
+			}
+			if body.Error.Code != tt.wantErr {
+				t.Errorf("got error code %q, want %q", body.Error.Code, tt.wantErr)
+			}
+		})
+	}
+}
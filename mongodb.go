@@ -3,18 +3,52 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"log"
+	"strings"
+	"time"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"go.mongodb.org/mongo-driver/bson"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
+// Scope of the access token used to authenticate to Azure Cosmos DB for MongoDB with Microsoft Entra ID
+const mongoTokenScope = "https://ossrdbms-aad.database.windows.net/.default"
+
+// MongoPoolOptions configures the connection pool of the mongo client
+type MongoPoolOptions struct {
+	MaxPoolSize uint64
+	MinPoolSize uint64
+	MaxIdleTime time.Duration
+}
+
+// MongoDBOrderRepo writes to the primary. Read-only queries go through reads and archiveReads, which use
+// the configured read preference so they can be served by secondaries.
 type MongoDBOrderRepo struct {
-	db *mongo.Collection
+	db           *mongo.Collection
+	archive      *mongo.Collection
+	reads        *mongo.Collection
+	archiveReads *mongo.Collection
+	leases       *mongo.Collection
+}
+
+// Parses a read preference mode such as primary, secondaryPreferred or nearest, returning nil if it is empty
+func parseReadPreference(mode string) (*readpref.ReadPref, error) {
+	if mode == "" {
+		return nil, nil
+	}
+	m, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, err
+	}
+	return readpref.New(m)
 }
 
-func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string, mongoUser string, mongoPassword string) (*MongoDBOrderRepo, error) {
+func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string, mongoArchiveCollection string, mongoLeaseCollection string, mongoUser string, mongoPassword string, pool MongoPoolOptions, readPreference *readpref.ReadPref) (*MongoDBOrderRepo, error) {
 	// create a context
 	ctx := context.Background()
 
@@ -32,6 +66,48 @@ func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string
 			SetTLSConfig(&tls.Config{InsecureSkipVerify: false})
 	}
 
+	return connectMongoDBOrderRepo(ctx, clientOptions, pool, readPreference, mongoDb, mongoCollection, mongoArchiveCollection, mongoLeaseCollection)
+}
+
+func NewMongoDBOrderRepoWithManagedIdentity(mongoUri string, mongoDb string, mongoCollection string, mongoArchiveCollection string, mongoLeaseCollection string, pool MongoPoolOptions, readPreference *readpref.ReadPref) (*MongoDBOrderRepo, error) {
+	// create a context
+	ctx := context.Background()
+
+	cred, err := azidentity.NewDefaultAzureCredential(nil)
+	if err != nil {
+		log.Printf("failed to create mongodb workload identity credential: %s", err)
+		return nil, err
+	}
+
+	// exchange the workload identity for an access token whenever the driver needs to authenticate
+	callback := func(ctx context.Context, _ *options.OIDCArgs) (*options.OIDCCredential, error) {
+		token, err := cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: []string{mongoTokenScope}})
+		if err != nil {
+			log.Printf("failed to get mongodb access token: %s", err)
+			return nil, err
+		}
+		return &options.OIDCCredential{
+			AccessToken: token.Token,
+			ExpiresAt:   &token.ExpiresOn,
+		}, nil
+	}
+
+	clientOptions := options.Client().ApplyURI(mongoUri).
+		SetAuth(options.Credential{
+			AuthMechanism:       "MONGODB-OIDC",
+			OIDCMachineCallback: callback,
+		}).
+		SetTLSConfig(&tls.Config{InsecureSkipVerify: false})
+
+	return connectMongoDBOrderRepo(ctx, clientOptions, pool, readPreference, mongoDb, mongoCollection, mongoArchiveCollection, mongoLeaseCollection)
+}
+
+func connectMongoDBOrderRepo(ctx context.Context, clientOptions *options.ClientOptions, pool MongoPoolOptions, readPreference *readpref.ReadPref, mongoDb string, mongoCollection string, mongoArchiveCollection string, mongoLeaseCollection string) (*MongoDBOrderRepo, error) {
+	clientOptions.SetMaxPoolSize(pool.MaxPoolSize).
+		SetMinPoolSize(pool.MinPoolSize).
+		SetMaxConnIdleTime(pool.MaxIdleTime)
+	log.Printf("mongodb connection pool: maxPoolSize=%d, minPoolSize=%d, maxIdleTime=%s", pool.MaxPoolSize, pool.MinPoolSize, pool.MaxIdleTime)
+
 	mongoClient, err := mongo.Connect(ctx, clientOptions)
 	if err != nil {
 		log.Printf("failed to connect to mongodb: %s", err)
@@ -41,6 +117,8 @@ func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string
 	err = mongoClient.Ping(ctx, nil)
 	if err != nil {
 		log.Printf("failed to ping database: %s", err)
+		// close the pool so retrying the connection doesn't leak it
+		mongoClient.Disconnect(context.Background())
 		return nil, err
 	} else {
 		log.Printf("pong from database")
@@ -50,14 +128,52 @@ func NewMongoDBOrderRepo(mongoUri string, mongoDb string, mongoCollection string
 	collection := mongoClient.Database(mongoDb).Collection(mongoCollection)
 	//defer collection.Database().Client().Disconnect(context.Background())
 
-	return &MongoDBOrderRepo{collection}, nil
+	// get a handle for the collection of archived orders
+	archive := mongoClient.Database(mongoDb).Collection(mongoArchiveCollection)
+
+	// get a handle for the collection of leases
+	leases := mongoClient.Database(mongoDb).Collection(mongoLeaseCollection)
+
+	// get handles for read-only queries, using the read preference if one is set
+	readOptions := options.Collection()
+	if readPreference != nil {
+		readOptions.SetReadPreference(readPreference)
+		log.Printf("mongodb read preference for read-only queries: %s", readPreference.Mode())
+	}
+	reads := mongoClient.Database(mongoDb).Collection(mongoCollection, readOptions)
+	archiveReads := mongoClient.Database(mongoDb).Collection(mongoArchiveCollection, readOptions)
+
+	return &MongoDBOrderRepo{collection, archive, reads, archiveReads, leases}, nil
 }
 
-func (r *MongoDBOrderRepo) GetPendingOrders() ([]Order, error) {
+func (r *MongoDBOrderRepo) GetPendingOrders(opts PendingOrdersOptions) ([]Order, error) {
 	ctx := context.TODO()
 
+	// mongo stores the fields in lowercase. Order IDs are strings, so they are sorted after they are read to
+	// compare numeric IDs as numbers.
+	findOptions := options.Find()
+	if opts.Sort.Field != SortByOrderID {
+		sortDirection := 1
+		if opts.Sort.Descending {
+			sortDirection = -1
+		}
+		findOptions.SetSort(bson.D{{Key: strings.ToLower(opts.Sort.Field), Value: sortDirection}})
+	}
+
+	filter := bson.M{"status": Pending}
+	createdAt := bson.M{}
+	if !opts.CreatedAfter.IsZero() {
+		createdAt["$gte"] = opts.CreatedAfter
+	}
+	if !opts.CreatedBefore.IsZero() {
+		createdAt["$lt"] = opts.CreatedBefore
+	}
+	if len(createdAt) > 0 {
+		filter["createdat"] = createdAt
+	}
+
 	var orders []Order
-	cursor, err := r.db.Find(ctx, bson.M{"status": Pending})
+	cursor, err := r.reads.Find(ctx, filter, findOptions)
 	if err != nil {
 		log.Printf("Failed to find records: %s", err)
 		return nil, err
@@ -80,19 +196,38 @@ func (r *MongoDBOrderRepo) GetPendingOrders() ([]Order, error) {
 		orders = append(orders, pendingOrder)
 	}
 
+	if opts.Sort.Field == SortByOrderID {
+		sortOrders(orders, opts.Sort)
+	}
 	return orders, nil
 }
 
 func (r *MongoDBOrderRepo) GetOrder(id string) (Order, error) {
+	return getMongoOrder(r.reads, r.archiveReads, id)
+}
+
+func (r *MongoDBOrderRepo) GetOrderForUpdate(id string) (Order, error) {
+	return getMongoOrder(r.db, r.archive, id)
+}
+
+// Gets an order from a collection, falling back to the archive
+func getMongoOrder(collection *mongo.Collection, archive *mongo.Collection, id string) (Order, error) {
 	var ctx = context.TODO()
 
 	filter := bson.D{{Key: "orderid", Value: bson.D{{Key: "$eq", Value: id}}}}
 
-	singleResult := r.db.FindOne(ctx, filter)
+	singleResult := collection.FindOne(ctx, filter)
 
 	var order Order
 	err := singleResult.Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// fall back to the archive for completed orders that have been archived
+		err = archive.FindOne(ctx, filter).Decode(&order)
+	}
 	if err != nil {
+		if errors.Is(err, mongo.ErrNoDocuments) {
+			return order, ErrOrderNotFound
+		}
 		log.Printf("Failed to decode order: %s", err)
 		return order, err
 	}
@@ -126,11 +261,22 @@ func (r *MongoDBOrderRepo) InsertOrders(orders []Order) error {
 func (r *MongoDBOrderRepo) UpdateOrder(order Order) error {
 	ctx := context.TODO()
 
+	if order.UpdatedAt.IsZero() {
+		order.UpdatedAt = time.Now().UTC()
+	}
+
 	filter := bson.D{{Key: "orderid", Value: order.OrderID}}
+	set := bson.D{
+		{Key: "status", Value: order.Status},
+		{Key: "updatedat", Value: order.UpdatedAt},
+		{Key: "lastmodifiedby", Value: order.LastModifiedBy},
+	}
+	if order.ExternalRef != "" {
+		set = append(set, bson.E{Key: "externalref", Value: order.ExternalRef})
+	}
 	update := bson.D{
-		{Key: "$set", Value: bson.D{
-			{Key: "status", Value: order.Status},
-		}},
+		{Key: "$set", Value: set},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: StatusChange{Status: order.Status, At: order.UpdatedAt, Actor: order.LastModifiedBy}}}},
 	}
 
 	log.Printf("Attempting to update order with filter: %+v and update: %+v", filter, update)
@@ -142,6 +288,364 @@ func (r *MongoDBOrderRepo) UpdateOrder(order Order) error {
 	}
 
 	log.Printf("MongoDB update result: Matched=%d, Modified=%d", updateResult.MatchedCount, updateResult.ModifiedCount)
+	if updateResult.MatchedCount == 0 {
+		return ErrOrderNotFound
+	}
 	return nil
 }
 
+func (r *MongoDBOrderRepo) TransitionOrder(id string, from []Status, change StatusChange) (Order, error) {
+	ctx := context.TODO()
+
+	if change.At.IsZero() {
+		change.At = time.Now().UTC()
+	}
+
+	// the status is checked as part of the update, so the order can't change in between
+	filter := bson.D{
+		{Key: "orderid", Value: id},
+		{Key: "status", Value: bson.D{{Key: "$in", Value: from}}},
+	}
+	set := bson.D{
+		{Key: "status", Value: change.Status},
+		{Key: "updatedat", Value: change.At},
+		{Key: "lastmodifiedby", Value: change.Actor},
+	}
+	if change.ExternalRef != "" {
+		set = append(set, bson.E{Key: "externalref", Value: change.ExternalRef})
+	}
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: change}}},
+	}
+
+	var order Order
+	err := r.db.FindOneAndUpdate(ctx, filter, update, options.FindOneAndUpdate().SetReturnDocument(options.After)).Decode(&order)
+	if errors.Is(err, mongo.ErrNoDocuments) {
+		// tell an order in another status apart from a missing order
+		count, err := r.db.CountDocuments(ctx, bson.D{{Key: "orderid", Value: id}})
+		if err != nil {
+			log.Printf("Failed to count orders: %s", err)
+			return Order{}, err
+		}
+		if count == 0 {
+			return Order{}, ErrOrderNotFound
+		}
+		return Order{}, ErrPreconditionFailed
+	}
+	if err != nil {
+		log.Printf("Failed to transition order in MongoDB: %s", err)
+		return Order{}, err
+	}
+
+	return order, nil
+}
+
+func (r *MongoDBOrderRepo) CountByStatus() (map[Status]int, error) {
+	ctx := context.TODO()
+
+	pipeline := mongo.Pipeline{
+		{{Key: "$group", Value: bson.D{
+			{Key: "_id", Value: "$status"},
+			{Key: "count", Value: bson.D{{Key: "$sum", Value: 1}}},
+		}}},
+	}
+
+	cursor, err := r.reads.Aggregate(ctx, pipeline)
+	if err != nil {
+		log.Printf("Failed to count orders by status: %s", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	counts := make(map[Status]int)
+	for cursor.Next(ctx) {
+		var result struct {
+			Status Status `bson:"_id"`
+			Count  int    `bson:"count"`
+		}
+		if err := cursor.Decode(&result); err != nil {
+			log.Printf("Failed to decode status count: %s", err)
+			return nil, err
+		}
+		counts[result.Status] = result.Count
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Printf("Failed to count orders by status: %s", err)
+		return nil, err
+	}
+
+	return counts, nil
+}
+
+func (r *MongoDBOrderRepo) GetOrdersByLastModifiedBy(actor string, page Page) ([]Order, error) {
+	ctx := context.TODO()
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "createdat", Value: 1}, {Key: "orderid", Value: 1}}).
+		SetSkip(int64(page.Offset)).
+		SetLimit(int64(page.Limit))
+
+	cursor, err := r.db.Find(ctx, bson.M{"lastmodifiedby": actor}, findOptions)
+	if err != nil {
+		log.Printf("Failed to find records: %s", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := []Order{}
+	if err := cursor.All(ctx, &orders); err != nil {
+		log.Printf("Failed to decode orders: %s", err)
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (r *MongoDBOrderRepo) SearchOrders(search OrderSearch, page Page) ([]Order, error) {
+	ctx := context.TODO()
+
+	// mongo stores the fields in lowercase, and only searchable fields are ever added to the filter
+	filter := bson.M{}
+	if search.CustomerID != "" {
+		filter["customerid"] = search.CustomerID
+	}
+	if search.Status != nil {
+		filter["status"] = *search.Status
+	}
+	if search.StoreID != "" {
+		filter["storeid"] = search.StoreID
+	}
+	if search.LastModifiedBy != "" {
+		filter["lastmodifiedby"] = search.LastModifiedBy
+	}
+	createdAt := bson.M{}
+	if !search.CreatedAfter.IsZero() {
+		createdAt["$gte"] = search.CreatedAfter
+	}
+	if !search.CreatedBefore.IsZero() {
+		createdAt["$lt"] = search.CreatedBefore
+	}
+	if len(createdAt) > 0 {
+		filter["createdat"] = createdAt
+	}
+
+	findOptions := options.Find().
+		SetSort(bson.D{{Key: "createdat", Value: 1}, {Key: "orderid", Value: 1}}).
+		SetSkip(int64(page.Offset)).
+		SetLimit(int64(page.Limit))
+
+	cursor, err := r.reads.Find(ctx, filter, findOptions)
+	if err != nil {
+		log.Printf("Failed to find records: %s", err)
+		return nil, err
+	}
+	defer cursor.Close(ctx)
+
+	orders := []Order{}
+	if err := cursor.All(ctx, &orders); err != nil {
+		log.Printf("Failed to decode orders: %s", err)
+		return nil, err
+	}
+
+	return orders, nil
+}
+
+func (r *MongoDBOrderRepo) ArchiveCompletedOrders(olderThan time.Duration) (int, error) {
+	ctx := context.TODO()
+
+	// orders are archived by when they were completed, and orders stored before updates were tracked
+	// fall back to when they were created
+	cutoff := time.Now().UTC().Add(-olderThan)
+	filter := bson.D{
+		{Key: "status", Value: Complete},
+		{Key: "$or", Value: bson.A{
+			bson.D{{Key: "updatedat", Value: bson.D{{Key: "$lt", Value: cutoff}}}},
+			bson.D{{Key: "updatedat", Value: bson.D{{Key: "$exists", Value: false}}}, {Key: "createdat", Value: bson.D{{Key: "$lt", Value: cutoff}}}},
+			bson.D{{Key: "updatedat", Value: bson.D{{Key: "$exists", Value: false}}}, {Key: "createdat", Value: bson.D{{Key: "$exists", Value: false}}}},
+		}},
+	}
+
+	cursor, err := r.db.Find(ctx, filter)
+	if err != nil {
+		log.Printf("Failed to find records: %s", err)
+		return 0, err
+	}
+	defer cursor.Close(ctx)
+
+	archived := 0
+	for cursor.Next(ctx) {
+		var document bson.M
+		if err := cursor.Decode(&document); err != nil {
+			log.Printf("Failed to decode order: %s", err)
+			return archived, err
+		}
+
+		// copy the order to the archive before removing it so it is never lost
+		_, err := r.archive.ReplaceOne(ctx, bson.D{{Key: "_id", Value: document["_id"]}}, document, options.Replace().SetUpsert(true))
+		if err != nil {
+			log.Printf("Failed to archive order: %s", err)
+			return archived, err
+		}
+
+		// only remove the order if it is unchanged since it was found, and take the archived copy back out
+		// if it was updated in between, such as by being reopened
+		result, err := r.db.DeleteOne(ctx, bson.D{
+			{Key: "_id", Value: document["_id"]},
+			{Key: "status", Value: Complete},
+			{Key: "updatedat", Value: document["updatedat"]},
+		})
+		if err != nil {
+			log.Printf("Failed to delete archived order: %s", err)
+			return archived, err
+		}
+		if result.DeletedCount == 0 {
+			_, err = r.archive.DeleteOne(ctx, bson.D{{Key: "_id", Value: document["_id"]}})
+			if err != nil {
+				log.Printf("Failed to remove order updated while it was archived: %s", err)
+				return archived, err
+			}
+			continue
+		}
+
+		archived++
+	}
+
+	if err := cursor.Err(); err != nil {
+		log.Printf("Failed to find records: %s", err)
+		return archived, err
+	}
+
+	log.Printf("Archived %v documents", archived)
+	return archived, nil
+}
+
+func (r *MongoDBOrderRepo) RecoverStuckOrders(stuckFor time.Duration, change StatusChange) (int, error) {
+	ctx := context.TODO()
+
+	if change.At.IsZero() {
+		change.At = time.Now().UTC()
+	}
+	cutoff := change.At.Add(-stuckFor)
+
+	// orders stored before updates were tracked fall back to when they were created
+	filter := bson.M{
+		"status": Processing,
+		"$or": bson.A{
+			bson.M{"updatedat": bson.M{"$lt": cutoff}},
+			bson.M{"updatedat": bson.M{"$exists": false}, "createdat": bson.M{"$lt": cutoff}},
+		},
+	}
+	set := bson.D{
+		{Key: "status", Value: change.Status},
+		{Key: "updatedat", Value: change.At},
+		{Key: "lastmodifiedby", Value: change.Actor},
+	}
+	update := bson.D{
+		{Key: "$set", Value: set},
+		{Key: "$push", Value: bson.D{{Key: "history", Value: change}}},
+	}
+
+	updateResult, err := r.db.UpdateMany(ctx, filter, update)
+	if err != nil {
+		log.Printf("Failed to recover stuck orders in MongoDB: %s", err)
+		return 0, err
+	}
+
+	log.Printf("Recovered %v stuck orders", updateResult.ModifiedCount)
+	return int(updateResult.ModifiedCount), nil
+}
+
+func (r *MongoDBOrderRepo) AcquireLease(ctx context.Context, name string, holder string, ttl time.Duration) (bool, error) {
+	now := time.Now().UTC()
+
+	// only match the lease if it is already held by this holder or has expired, otherwise the upsert
+	// tries to insert a second lease with the same ID and fails
+	filter := bson.M{
+		"_id": name,
+		"$or": bson.A{
+			bson.M{"holder": holder},
+			bson.M{"expiresat": bson.M{"$lte": now}},
+		},
+	}
+	update := bson.M{"$set": bson.M{"holder": holder, "expiresat": now.Add(ttl)}}
+
+	_, err := r.leases.UpdateOne(ctx, filter, update, options.Update().SetUpsert(true))
+	if mongo.IsDuplicateKeyError(err) {
+		return false, nil
+	}
+	if err != nil {
+		log.Printf("Failed to acquire lease %s: %s", name, err)
+		return false, err
+	}
+	return true, nil
+}
+
+func (r *MongoDBOrderRepo) ReleaseLease(ctx context.Context, name string, holder string) error {
+	_, err := r.leases.DeleteOne(ctx, bson.M{"_id": name, "holder": holder})
+	if err != nil {
+		log.Printf("Failed to release lease %s: %s", name, err)
+		return err
+	}
+	return nil
+}
+
+func (r *MongoDBOrderRepo) Ping(ctx context.Context) error {
+	return r.db.Database().Client().Ping(ctx, nil)
+}
+
+func (r *MongoDBOrderRepo) EnsureIndexes(ctx context.Context) error {
+	// mongo stores the fields in lowercase
+	fields := make([]string, len(indexedFields))
+	for i, field := range indexedFields {
+		fields[i] = strings.ToLower(field)
+	}
+
+	if err := ensureMongoIndexes(ctx, r.db, fields); err != nil {
+		return err
+	}
+	// archived orders are only looked up by ID
+	return ensureMongoIndexes(ctx, r.archive, []string{"orderid"})
+}
+
+// Creates an ascending index on each field of a collection that doesn't have one yet
+func ensureMongoIndexes(ctx context.Context, collection *mongo.Collection, fields []string) error {
+	cursor, err := collection.Indexes().List(ctx)
+	if err != nil {
+		log.Printf("Failed to list indexes of %s: %s", collection.Name(), err)
+		return err
+	}
+
+	var existing []bson.M
+	if err := cursor.All(ctx, &existing); err != nil {
+		log.Printf("Failed to list indexes of %s: %s", collection.Name(), err)
+		return err
+	}
+	existingNames := make(map[string]bool, len(existing))
+	for _, index := range existing {
+		if name, ok := index["name"].(string); ok {
+			existingNames[name] = true
+		}
+	}
+
+	for _, field := range fields {
+		// name the index the same way mongo does by default
+		name := field + "_1"
+		if existingNames[name] {
+			log.Printf("Index %s on %s already exists", name, collection.Name())
+			continue
+		}
+
+		_, err := collection.Indexes().CreateOne(ctx, mongo.IndexModel{
+			Keys:    bson.D{{Key: field, Value: 1}},
+			Options: options.Index().SetName(name),
+		})
+		if err != nil {
+			log.Printf("Failed to create index %s on %s: %s", name, collection.Name(), err)
+			return err
+		}
+		log.Printf("Created index %s on %s", name, collection.Name())
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"regexp"
+	"strconv"
+)
+
+// Pattern order IDs must match, or nil to only accept numeric IDs
+var orderIDPattern *regexp.Regexp
+
+// Prefix of the IDs generated for new orders, so they can match the order ID pattern
+var orderIDPrefix string
+
+// Compiles the order ID pattern so it has to match the whole ID
+func compileOrderIDPattern(pattern string) (*regexp.Regexp, error) {
+	if pattern == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// Validates an order ID and returns it in its canonical form
+func sanitizeOrderID(id string) (string, error) {
+	if orderIDPattern != nil {
+		if !orderIDPattern.MatchString(id) {
+			return "", fmt.Errorf("order id %q does not match pattern %s", id, orderIDPattern)
+		}
+		return id, nil
+	}
+
+	i, err := strconv.Atoi(id)
+	if err != nil {
+		return "", fmt.Errorf("order id %q must be a number", id)
+	}
+	return strconv.Itoa(i), nil
+}
+
+// Generates the ID of a new order as the prefix followed by a random number, which is just the number
+// unless a prefix is configured
+func newOrderID() string {
+	return orderIDPrefix + strconv.Itoa(rand.Intn(100000))
+}
@@ -0,0 +1,71 @@
+package main
+
+import "testing"
+
+func TestSanitizeOrderID(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		id      string
+		want    string
+		wantErr bool
+	}{
+		{name: "numeric", id: "42", want: "42"},
+		{name: "numeric is canonicalized", id: "0042", want: "42"},
+		{name: "numeric rejects letters", id: "WEB-42", wantErr: true},
+		{name: "pattern", pattern: "(WEB|KIOSK)-[0-9]+", id: "KIOSK-7", want: "KIOSK-7"},
+		{name: "pattern matches the whole ID", pattern: "(WEB|KIOSK)-[0-9]+", id: "WEB-7x", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := compileOrderIDPattern(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			orderIDPattern = pattern
+			defer func() { orderIDPattern = nil }()
+
+			got, err := sanitizeOrderID(tt.id)
+			if (err != nil) != tt.wantErr || got != tt.want {
+				t.Errorf("sanitizeOrderID(%q) = %q, %v, want %q, error %v", tt.id, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNewOrderIDMatchesPattern(t *testing.T) {
+	tests := []struct {
+		name    string
+		pattern string
+		prefix  string
+		wantErr bool
+	}{
+		{name: "numeric"},
+		{name: "prefix matching the pattern", pattern: "(WEB|KIOSK)-[0-9]+", prefix: "WEB-"},
+		{name: "no prefix for a prefixed pattern", pattern: "(WEB|KIOSK)-[0-9]+", wantErr: true},
+		{name: "prefix without a pattern", prefix: "WEB-", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pattern, err := compileOrderIDPattern(tt.pattern)
+			if err != nil {
+				t.Fatal(err)
+			}
+			orderIDPattern, orderIDPrefix = pattern, tt.prefix
+			defer func() { orderIDPattern, orderIDPrefix = nil, "" }()
+
+			for i := 0; i < 100; i++ {
+				id := newOrderID()
+				sanitized, err := sanitizeOrderID(id)
+				if (err != nil) != tt.wantErr {
+					t.Fatalf("sanitizeOrderID(%q) returned error %v, want error %v", id, err, tt.wantErr)
+				}
+				if err == nil && sanitized != id {
+					t.Fatalf("generated ID %q is stored as %q", id, sanitized)
+				}
+			}
+		})
+	}
+}
@@ -2,13 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"log"
-	"math/rand"
 	"os"
-	"strconv"
 	"time"
 
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
@@ -16,7 +17,73 @@ import (
 	"github.com/Azure/go-amqp"
 )
 
-func getOrdersFromQueue() ([]Order, error) {
+// ErrNoMessages is returned when the queue has no orders waiting
+var ErrNoMessages = errors.New("no messages in the queue")
+
+// Most messages pulled from the queue in one fetch, the rest are left for the next fetch
+var orderFetchMaxBatch = 500
+
+// Application property this service sets on the messages of requeued orders to the HMAC-SHA256 of the
+// order, so they keep their order ID instead of being treated as new orders. Any producer can set the
+// property, so it is only trusted when it was signed with requeueSecret.
+const requeuedProperty = "makelineRequeued"
+
+// Secret requeued orders are signed with
+var requeueSecret []byte
+
+// Gets the secret requeued orders are signed with from ORDER_REQUEUE_SECRET, or generates one that only
+// this instance knows if it isn't set
+func loadRequeueSecret() ([]byte, error) {
+	if secret := os.Getenv("ORDER_REQUEUE_SECRET"); secret != "" {
+		return []byte(secret), nil
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// Signs the JSON of a requeued order
+func signRequeuedOrder(data []byte) string {
+	mac := hmac.New(sha256.New, requeueSecret)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Reports whether a message was requeued by this service, which is only the case if it is signed
+func isRequeuedMessage(data []byte, properties map[string]any) bool {
+	signature, ok := properties[requeuedProperty].(string)
+	return ok && len(requeueSecret) > 0 && hmac.Equal([]byte(signature), []byte(signRequeuedOrder(data)))
+}
+
+// OrderBatch is a batch of orders received from the queue. Their messages stay on the queue until the batch
+// is completed, so orders that couldn't be saved are delivered again.
+type OrderBatch struct {
+	Orders []Order
+	// settle completes or abandons the messages of the orders and closes the connection they were received on
+	settle func(saved bool)
+}
+
+// Complete removes the messages of the orders from the queue once they have been saved
+func (b *OrderBatch) Complete() {
+	if b != nil && b.settle != nil {
+		b.settle(true)
+		b.settle = nil
+	}
+}
+
+// Abandon returns the messages of the orders to the queue to be delivered again
+func (b *OrderBatch) Abandon() {
+	if b != nil && b.settle != nil {
+		b.settle(false)
+		b.settle = nil
+	}
+}
+
+// Receives a batch of orders from the queue. The batch must be completed once the orders are saved, or
+// abandoned if they couldn't be.
+func getOrdersFromQueue() (*OrderBatch, error) {
 	ctx := context.Background()
 
 	var orders []Order
@@ -42,53 +109,79 @@ func getOrdersFromQueue() ([]Order, error) {
 	if orderQueueHostName != "" && useWorkloadIdentityAuth == "true" {
 		cred, err := azidentity.NewDefaultAzureCredential(nil)
 		if err != nil {
-			log.Fatalf("failed to obtain a workload identity credential: %v", err)
+			log.Printf("failed to obtain a workload identity credential: %v", err)
+			return nil, err
 		}
 
 		client, err := azservicebus.NewClient(orderQueueHostName, cred, nil)
 		if err != nil {
-			log.Fatalf("failed to obtain a service bus client with workload identity credential: %v", err)
+			log.Printf("failed to obtain a service bus client with workload identity credential: %v", err)
+			return nil, err
 		} else {
-			fmt.Println("successfully created a service bus client with workload identity credentials")
+			log.Printf("successfully created a service bus client with workload identity credentials")
 		}
 
 		receiver, err := client.NewReceiverForQueue(orderQueueName, nil)
 		if err != nil {
-			log.Fatalf("failed to create receiver: %v", err)
+			log.Printf("failed to create receiver: %v", err)
+			client.Close(context.TODO())
+			return nil, err
+		}
+		closeReceiver := func() {
+			receiver.Close(context.TODO())
+			client.Close(context.TODO())
 		}
-		defer receiver.Close(context.TODO())
 
-		messages, err := receiver.ReceiveMessages(context.TODO(), 10, nil)
+		messages, err := receiver.ReceiveMessages(context.TODO(), min(10, orderFetchMaxBatch), nil)
 		if err != nil {
-			log.Fatalf("failed to receive messages: %v", err)
+			log.Printf("failed to receive messages: %v", err)
+			closeReceiver()
+			return nil, err
 		}
 
+		// the messages are locked until they are settled, once the orders have been saved or couldn't be
+		settle := func(messages []*azservicebus.ReceivedMessage, saved bool) {
+			for _, message := range messages {
+				if saved {
+					err = receiver.CompleteMessage(context.TODO(), message, nil)
+				} else {
+					err = receiver.AbandonMessage(context.TODO(), message, nil)
+				}
+				if err != nil {
+					// the message is delivered again once its lock expires
+					log.Printf("failed to settle message %s: %v", message.MessageID, err)
+				}
+			}
+			closeReceiver()
+		}
+
+		var received []*azservicebus.ReceivedMessage
 		for _, message := range messages {
 			log.Printf("message received: %s\n", string(message.Body))
 
-			// First, unmarshal the JSON data into a string
-			var jsonStr string
-			err = json.Unmarshal(message.Body, &jsonStr)
-			if err != nil {
-				log.Printf("failed to deserialize message: %s", err)
-				return nil, err
-			}
-
-			// Then, unmarshal the string into an Order
-			order, err := unmarshalOrderFromQueue([]byte(jsonStr))
+			order, err := unmarshalServiceBusOrder(message)
 			if err != nil {
 				log.Printf("failed to unmarshal message: %v", err)
-				return nil, err
+				poisonTracker.RecordFailure(message.Body, err)
+
+				// only this message is invalid, so dead-letter it and carry on with the rest of the batch
+				reason, description := deadLetterReason(err), err.Error()
+				if err := receiver.DeadLetterMessage(context.TODO(), message, &azservicebus.DeadLetterOptions{Reason: &reason, ErrorDescription: &description}); err != nil {
+					log.Printf("failed to dead-letter message %s: %v", message.MessageID, err)
+				}
+				continue
 			}
 
 			// Add order to []order slice
 			orders = append(orders, order)
+			received = append(received, message)
+		}
 
-			err = receiver.CompleteMessage(context.TODO(), message, nil)
-			if err != nil {
-				log.Fatalf("failed to complete message: %v", err)
-			}
+		if len(orders) == 0 {
+			closeReceiver()
+			return nil, ErrNoMessages
 		}
+		return &OrderBatch{Orders: orders, settle: func(saved bool) { settle(received, saved) }}, nil
 	} else {
 		// Get order queue connection string from environment variable
 		orderQueueUri := os.Getenv("ORDER_QUEUE_URI")
@@ -119,69 +212,133 @@ func getOrdersFromQueue() ([]Order, error) {
 			log.Printf("%s: %s", "failed to connect to order queue", err)
 			return nil, err
 		}
-		defer conn.Close()
 
 		session, err := conn.NewSession(ctx, nil)
 		if err != nil {
-			log.Printf("unable to create a new session")
+			log.Printf("unable to create a new session: %s", err)
+			conn.Close()
+			return nil, err
 		}
 
-		{
-			// create a receiver
-			receiver, err := session.NewReceiver(ctx, orderQueueName, nil)
-			if err != nil {
-				log.Printf("creating receiver link: %s", err)
-				return nil, err
-			}
-			defer func() {
-				ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
-				receiver.Close(ctx)
-				cancel()
-			}()
-
-			for {
-				log.Printf("getting orders")
-
-				ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
-				defer cancel()
+		// create a receiver
+		receiver, err := session.NewReceiver(ctx, orderQueueName, nil)
+		if err != nil {
+			log.Printf("creating receiver link: %s", err)
+			conn.Close()
+			return nil, err
+		}
+		closeReceiver := func() {
+			ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+			receiver.Close(ctx)
+			cancel()
+			conn.Close()
+		}
 
-				// receive next message
-				msg, err := receiver.Receive(ctx, nil)
+		// the messages stay unsettled until the orders have been saved or couldn't be
+		var messages []*amqp.Message
+		settle := func(saved bool) {
+			for _, msg := range messages {
+				if saved {
+					err = receiver.AcceptMessage(context.TODO(), msg)
+				} else {
+					err = receiver.ReleaseMessage(context.TODO(), msg)
+				}
 				if err != nil {
-					if err.Error() == "context deadline exceeded" {
-						log.Printf("no more orders for you: %v", err.Error())
-						break
-					} else {
-						return nil, err
-					}
+					log.Printf("failure settling message: %s", err)
 				}
+			}
+			closeReceiver()
+		}
 
-				messageBody := string(msg.GetData())
-				log.Printf("message received: %s\n", messageBody)
+		// stop once the batch is full, messages that aren't received stay in the queue
+		for len(orders) < orderFetchMaxBatch {
+			log.Printf("getting orders")
 
-				order, err := unmarshalOrderFromQueue(msg.GetData())
-				if err != nil {
-					log.Printf("failed to unmarshal message: %s", err)
+			ctx, cancel := context.WithTimeout(ctx, 1*time.Second)
+			defer cancel()
+
+			// receive next message
+			msg, err := receiver.Receive(ctx, nil)
+			if err != nil {
+				if err.Error() == "context deadline exceeded" {
+					log.Printf("no more orders for you: %v", err.Error())
+					break
+				} else {
+					settle(false)
 					return nil, err
 				}
+			}
 
-				// Add order to []order slice
-				orders = append(orders, order)
+			messageBody := string(msg.GetData())
+			log.Printf("message received: %s\n", messageBody)
 
-				// accept message
-				if err = receiver.AcceptMessage(context.TODO(), msg); err != nil {
-					log.Printf("failure accepting message: %s", err)
-					// remove the order from the slice so that we pick it up on the next run
-					orders = orders[:len(orders)-1]
+			order, err := unmarshalOrderFromQueue(msg.GetData(), msg.ApplicationProperties)
+			if err != nil {
+				log.Printf("failed to unmarshal message: %s", err)
+				poisonTracker.RecordFailure(msg.GetData(), err)
+
+				// only this message is invalid, so reject it and carry on with the rest of the batch
+				condition := amqp.ErrCondDecodeError
+				var validationErr *ValidationError
+				if errors.As(err, &validationErr) {
+					condition = amqp.ErrCondInvalidField
 				}
+				if err := receiver.RejectMessage(context.TODO(), msg, &amqp.Error{Condition: condition, Description: err.Error()}); err != nil {
+					log.Printf("failure rejecting message: %s", err)
+				}
+				continue
 			}
+
+			// Add order to []order slice
+			orders = append(orders, order)
+			messages = append(messages, msg)
+		}
+
+		if len(orders) == 0 {
+			closeReceiver()
+			return nil, ErrNoMessages
 		}
+		return &OrderBatch{Orders: orders, settle: settle}, nil
+	}
+}
+
+// Unmarshals an order from a Service Bus message, whose body is the order encoded as a JSON string
+func unmarshalServiceBusOrder(message *azservicebus.ReceivedMessage) (Order, error) {
+	// First, unmarshal the JSON data into a string
+	var jsonStr string
+	if err := json.Unmarshal(message.Body, &jsonStr); err != nil {
+		log.Printf("failed to deserialize message: %s", err)
+		return Order{}, err
+	}
+
+	// Then, unmarshal the string into an Order
+	return unmarshalOrderFromQueue([]byte(jsonStr), message.ApplicationProperties)
+}
+
+// Reason a message is dead-lettered with when its order can't be received
+func deadLetterReason(err error) string {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		return "ValidationFailed"
 	}
-	return orders, nil
+	return "DeserializationFailed"
 }
 
-func unmarshalOrderFromQueue(data []byte) (Order, error) {
+// Unmarshals an order from a queue message. Only orders requeued by this service keep their order ID
+// and history, every other order is new.
+func unmarshalOrderFromQueue(data []byte, properties map[string]any) (Order, error) {
 	var order Order
+	requeued := isRequeuedMessage(data, properties)
+
+	// adapt messages from producers with a different schema, requeued orders already use this one
+	if messageMapping != nil && !requeued {
+		mapped, err := messageMapping.Apply(data)
+		if err != nil {
+			log.Printf("failed to map message: %v\n", err)
+			return Order{}, err
+		}
+		data = mapped
+	}
 
 	err := json.Unmarshal(data, &order)
 	if err != nil {
@@ -189,11 +346,148 @@ func unmarshalOrderFromQueue(data []byte) (Order, error) {
 		return Order{}, err
 	}
 
-	// add orderkey to order
-	order.OrderID = strconv.Itoa(rand.Intn(100000))
+	// add orderkey to order, unless it was requeued by this service and already has one
+	order.requeued = requeued
+	if !requeued {
+		order.OrderID = newOrderID()
+		order.History = nil
+	}
 
 	// set the status to pending
 	order.Status = Pending
 
+	if fieldErrors := validateOrder(order, Pending); len(fieldErrors) > 0 {
+		err := &ValidationError{fieldErrors}
+		log.Printf("failed to validate order: %v\n", err)
+		return Order{}, err
+	}
+
 	return order, nil
 }
+
+// OrderPublisher sends orders to a downstream queue
+type OrderPublisher interface {
+	PublishOrder(order Order) error
+}
+
+// QueueOrderPublisher publishes orders to a queue on the same broker the orders are received from
+type QueueOrderPublisher struct {
+	queueName string
+	// requeue marks the messages as requeued orders and encodes them the way order producers do, so they
+	// can be received from the order queue again
+	requeue bool
+}
+
+func NewQueueOrderPublisher(queueName string) *QueueOrderPublisher {
+	return &QueueOrderPublisher{queueName: queueName}
+}
+
+// NewRequeueOrderPublisher publishes requeued orders to the queue orders are received from
+func NewRequeueOrderPublisher(queueName string) *QueueOrderPublisher {
+	return &QueueOrderPublisher{queueName: queueName, requeue: true}
+}
+
+func (p *QueueOrderPublisher) PublishOrder(order Order) error {
+	ctx := context.Background()
+
+	body, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("failed to marshal order: %v", err)
+		return err
+	}
+
+	var properties map[string]any
+	if p.requeue {
+		properties = map[string]any{requeuedProperty: signRequeuedOrder(body)}
+	}
+
+	// check if USE_WORKLOAD_IDENTITY_AUTH is set
+	useWorkloadIdentityAuth := os.Getenv("USE_WORKLOAD_IDENTITY_AUTH")
+	if useWorkloadIdentityAuth == "" {
+		useWorkloadIdentityAuth = "false"
+	}
+
+	orderQueueHostName := os.Getenv("AZURE_SERVICEBUS_FULLYQUALIFIEDNAMESPACE")
+	if orderQueueHostName == "" {
+		orderQueueHostName = os.Getenv("ORDER_QUEUE_HOSTNAME")
+	}
+
+	if orderQueueHostName != "" && useWorkloadIdentityAuth == "true" {
+		cred, err := azidentity.NewDefaultAzureCredential(nil)
+		if err != nil {
+			log.Printf("failed to obtain a workload identity credential: %v", err)
+			return err
+		}
+
+		client, err := azservicebus.NewClient(orderQueueHostName, cred, nil)
+		if err != nil {
+			log.Printf("failed to obtain a service bus client with workload identity credential: %v", err)
+			return err
+		}
+		defer client.Close(ctx)
+
+		sender, err := client.NewSender(p.queueName, nil)
+		if err != nil {
+			log.Printf("failed to create sender: %v", err)
+			return err
+		}
+		defer sender.Close(ctx)
+
+		// producers send orders to service bus as a JSON string, which is how they are received
+		if p.requeue {
+			body, err = json.Marshal(string(body))
+			if err != nil {
+				log.Printf("failed to marshal order: %v", err)
+				return err
+			}
+		}
+
+		err = sender.SendMessage(ctx, &azservicebus.Message{Body: body, ApplicationProperties: properties}, nil)
+		if err != nil {
+			log.Printf("failed to send message: %v", err)
+			return err
+		}
+		return nil
+	}
+
+	// Get order queue connection string from environment variable
+	orderQueueUri := os.Getenv("ORDER_QUEUE_URI")
+	if orderQueueUri == "" {
+		log.Printf("ORDER_QUEUE_URI is not set")
+		return errors.New("ORDER_QUEUE_URI is not set")
+	}
+
+	orderQueueUsername := os.Getenv("ORDER_QUEUE_USERNAME")
+	orderQueuePassword := os.Getenv("ORDER_QUEUE_PASSWORD")
+
+	conn, err := amqp.Dial(ctx, orderQueueUri, &amqp.ConnOptions{
+		SASLType: amqp.SASLTypePlain(orderQueueUsername, orderQueuePassword),
+	})
+	if err != nil {
+		log.Printf("%s: %s", "failed to connect to order queue", err)
+		return err
+	}
+	defer conn.Close()
+
+	session, err := conn.NewSession(ctx, nil)
+	if err != nil {
+		log.Printf("unable to create a new session: %s", err)
+		return err
+	}
+
+	sender, err := session.NewSender(ctx, p.queueName, nil)
+	if err != nil {
+		log.Printf("creating sender link: %s", err)
+		return err
+	}
+	defer sender.Close(ctx)
+
+	message := amqp.NewMessage(body)
+	message.ApplicationProperties = properties
+	err = sender.Send(ctx, message, nil)
+	if err != nil {
+		log.Printf("failed to send message: %s", err)
+		return err
+	}
+	return nil
+}
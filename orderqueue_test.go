@@ -0,0 +1,46 @@
+package main
+
+import "testing"
+
+func TestUnmarshalOrderFromQueue(t *testing.T) {
+	requeueSecret = []byte("secret")
+	messageMapping = &MessageMapping{Rename: map[string]string{"customer": "customerId"}}
+	defer func() {
+		requeueSecret = nil
+		messageMapping = nil
+	}()
+
+	requeued := `{"orderId":"order-1","customerId":"customer-1","items":[{"productId":1,"quantity":1,"price":1}]}`
+	foreign := `{"orderId":"order-1","customer":"customer-1","items":[{"productId":1,"quantity":1,"price":1}]}`
+
+	tests := []struct {
+		name         string
+		data         string
+		properties   map[string]any
+		wantRequeued bool
+	}{
+		{name: "new order", data: foreign},
+		{name: "requeued by this service", data: requeued, properties: map[string]any{requeuedProperty: signRequeuedOrder([]byte(requeued))}, wantRequeued: true},
+		{name: "foreign message with the flag", data: foreign, properties: map[string]any{requeuedProperty: true}},
+		{name: "foreign message with another signature", data: foreign, properties: map[string]any{requeuedProperty: signRequeuedOrder([]byte(requeued))}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			order, err := unmarshalOrderFromQueue([]byte(tt.data), tt.properties)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if order.requeued != tt.wantRequeued {
+				t.Errorf("got requeued %v, want %v", order.requeued, tt.wantRequeued)
+			}
+			// the mapping is only skipped for requeued orders, which already use the order schema
+			if order.CustomerID != "customer-1" {
+				t.Errorf("got customer %q, want the message mapped to customer-1", order.CustomerID)
+			}
+			if keptID := order.OrderID == "order-1"; keptID != tt.wantRequeued {
+				t.Errorf("got order ID %s, want it kept only for requeued orders", order.OrderID)
+			}
+		})
+	}
+}
@@ -1,10 +1,96 @@
 package main
 
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrOrderNotFound is returned by a repo when no order matches the requested ID
+var ErrOrderNotFound = errors.New("order not found")
+
+// ErrPreconditionFailed is returned by a repo when an order isn't in a status a transition expects
+var ErrPreconditionFailed = errors.New("order is not in the expected status")
+
+// PartitionMismatchError is returned when an order only exists under a partition value other than the configured one
+type PartitionMismatchError struct {
+	OrderID         string
+	PartitionValue  string
+	PartitionValues []string
+}
+
+func (e *PartitionMismatchError) Error() string {
+	return fmt.Sprintf("order %s not found in partition %q but exists in partitions %q", e.OrderID, e.PartitionValue, e.PartitionValues)
+}
+
+// UnknownStatusError is returned when a status in JSON is neither a number nor the name of a status
+type UnknownStatusError struct {
+	Value string
+}
+
+func (e *UnknownStatusError) Error() string {
+	return fmt.Sprintf("unknown order status %s", e.Value)
+}
+
 type Order struct {
 	OrderID    string `json:"orderId"`
 	CustomerID string `json:"customerId"`
 	Items      []Item `json:"items"`
 	Status     Status `json:"status"`
+	// ExternalRef is the reference billing supplies when completing the order
+	ExternalRef string    `json:"externalRef,omitempty"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// UpdatedAt is when the order was last updated, or when it was created if it hasn't been updated
+	UpdatedAt time.Time `json:"updatedAt"`
+	// LastModifiedBy is the actor that last updated the order
+	LastModifiedBy string `json:"lastModifiedBy,omitempty"`
+	// Total is the sum of each item's price times its quantity
+	Total float64 `json:"total"`
+	// StoreID is the store the order was placed in
+	StoreID string `json:"storeId,omitempty"`
+	// History lists the status changes of the order, oldest first
+	History []StatusChange `json:"history,omitempty"`
+	// requeued is set on orders received from the queue that this service requeued, which are already stored
+	requeued bool
+}
+
+// Actor recorded for changes made without naming an actor
+const anonymousActor = "anonymous"
+
+// Returns the actor, or anonymousActor if none was given, so every change is attributed to someone
+func actorOrAnonymous(actor string) string {
+	if actor == "" {
+		return anonymousActor
+	}
+	return actor
+}
+
+// StatusChange records an order moving to a status
+type StatusChange struct {
+	Status Status    `json:"status"`
+	At     time.Time `json:"at"`
+	Actor  string    `json:"actor,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	// ExternalRef is set on the order by the change. It isn't recorded in the history.
+	ExternalRef string `json:"-" bson:"-"`
+}
+
+// Largest difference between a supplied and computed total that is treated as rounding
+const totalEpsilon = 0.01
+
+// ComputeTotal sums the price times the quantity of each item
+func (o *Order) ComputeTotal() float64 {
+	var total float64
+	for _, item := range o.Items {
+		total += item.Price * float64(item.Quantity)
+	}
+	return total
 }
 
 type Status int
@@ -13,25 +99,243 @@ const (
 	Pending Status = iota
 	Processing
 	Complete
+	Cancelled
+	// PendingCompletion orders have been completed but need to be confirmed before they are Complete
+	PendingCompletion
 )
 
+// Statuses lists every order status
+var Statuses = []Status{Pending, Processing, Complete, Cancelled, PendingCompletion}
+
+var statusNames = map[Status]string{
+	Pending:           "pending",
+	Processing:        "processing",
+	Complete:          "complete",
+	Cancelled:         "cancelled",
+	PendingCompletion: "pendingCompletion",
+}
+
+// Other names accepted for statuses in JSON
+var statusAliases = map[string]Status{
+	"completed": Complete,
+	"canceled":  Cancelled,
+}
+
+// Statuses an order can move to from its current status
+var statusTransitions = map[Status][]Status{
+	Pending:           {Processing, PendingCompletion, Complete},
+	Processing:        {Pending, Processing, PendingCompletion, Complete},
+	PendingCompletion: {Processing, Complete},
+	Complete:          {Processing, Complete},
+}
+
+func (s Status) String() string {
+	if name, ok := statusNames[s]; ok {
+		return name
+	}
+	return fmt.Sprintf("Status(%d)", int(s))
+}
+
+// ParseStatus looks up a status by its name or an alias, ignoring case
+func ParseStatus(name string) (Status, error) {
+	for status, statusName := range statusNames {
+		if strings.EqualFold(name, statusName) {
+			return status, nil
+		}
+	}
+	if status, ok := statusAliases[strings.ToLower(name)]; ok {
+		return status, nil
+	}
+	return 0, &UnknownStatusError{Value: fmt.Sprintf("%q", name)}
+}
+
+// MarshalJSON writes the status as its name, or as a number if it has no name
+func (s Status) MarshalJSON() ([]byte, error) {
+	if name, ok := statusNames[s]; ok {
+		return json.Marshal(name)
+	}
+	return json.Marshal(int(s))
+}
+
+// UnmarshalJSON accepts either the number of a status or its name in any case
+func (s *Status) UnmarshalJSON(data []byte) error {
+	if string(data) == "null" {
+		return nil
+	}
+
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		status, err := ParseStatus(name)
+		if err != nil {
+			return err
+		}
+		*s = status
+		return nil
+	}
+
+	var number int
+	if err := json.Unmarshal(data, &number); err != nil {
+		return &UnknownStatusError{Value: string(data)}
+	}
+	*s = Status(number)
+	return nil
+}
+
+func (s Status) CanTransitionTo(next Status) bool {
+	for _, status := range statusTransitions[s] {
+		if status == next {
+			return true
+		}
+	}
+	return false
+}
+
 type Item struct {
 	Product  int     `json:"productId"`
 	Quantity int     `json:"quantity"`
 	Price    float64 `json:"price"`
 }
 
+// OrderSort is the field and direction pending orders are returned in
+type OrderSort struct {
+	Field      string
+	Descending bool
+}
+
+// Fields orders can be sorted by
+const (
+	SortByOrderID   = "orderId"
+	SortByCreatedAt = "createdAt"
+)
+
+// Parses a sort spec such as "createdAt" or "-orderId", where a leading minus sorts in descending order.
+// An empty spec sorts the oldest orders first.
+func ParseOrderSort(spec string) (OrderSort, error) {
+	if spec == "" {
+		return OrderSort{Field: SortByCreatedAt}, nil
+	}
+
+	sort := OrderSort{Field: strings.TrimPrefix(spec, "-")}
+	sort.Descending = sort.Field != spec
+
+	switch sort.Field {
+	case SortByOrderID, SortByCreatedAt:
+		return sort, nil
+	default:
+		return OrderSort{}, fmt.Errorf("unknown sort field %q", sort.Field)
+	}
+}
+
+// Sorts orders in place, for stores that can't sort a query themselves and for order IDs, which stores
+// compare as strings
+func sortOrders(orders []Order, sort OrderSort) {
+	slices.SortStableFunc(orders, func(a, b Order) int {
+		var c int
+		if sort.Field == SortByOrderID {
+			c = compareOrderIDs(a.OrderID, b.OrderID)
+		} else {
+			c = a.CreatedAt.Compare(b.CreatedAt)
+		}
+		if sort.Descending {
+			return -c
+		}
+		return c
+	})
+}
+
+// Compares order IDs numerically when both are numbers, so 9 sorts before 10. Numeric IDs sort before
+// other IDs, which are compared as strings.
+func compareOrderIDs(a, b string) int {
+	ai, aErr := strconv.ParseInt(a, 10, 64)
+	bi, bErr := strconv.ParseInt(b, 10, 64)
+	switch {
+	case aErr == nil && bErr == nil:
+		return cmp.Compare(ai, bi)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// Fills in the fields that orders stored by earlier versions of the service don't have
+func (o *Order) backfill() {
+	if o.Total == 0 {
+		o.Total = o.ComputeTotal()
+	}
+	if o.UpdatedAt.IsZero() {
+		o.UpdatedAt = o.CreatedAt
+	}
+}
+
+// PendingOrdersOptions controls which pending orders are returned and in what order
+type PendingOrdersOptions struct {
+	Sort OrderSort
+	// CreatedAfter only includes orders created at or after this time, unless it is zero
+	CreatedAfter time.Time
+	// CreatedBefore only includes orders created before this time, unless it is zero
+	CreatedBefore time.Time
+}
+
+// Reports whether an order was created within the range of the options
+func (o PendingOrdersOptions) inCreatedRange(order Order) bool {
+	if !o.CreatedAfter.IsZero() && order.CreatedAt.Before(o.CreatedAfter) {
+		return false
+	}
+	if !o.CreatedBefore.IsZero() && !order.CreatedAt.Before(o.CreatedBefore) {
+		return false
+	}
+	return true
+}
+
+// Order fields the service queries by, which the database should index
+var indexedFields = []string{"orderId", "status", "createdAt", "updatedAt", "lastModifiedBy", "customerId"}
+
+// Page selects a range of results
+type Page struct {
+	Offset int
+	Limit  int
+}
+
 type OrderRepo interface {
-	GetPendingOrders() ([]Order, error)
+	GetPendingOrders(opts PendingOrdersOptions) ([]Order, error)
 	GetOrder(id string) (Order, error)
+	// GetOrderForUpdate gets an order bypassing any read preference, for reads that decide what an update writes
+	GetOrderForUpdate(id string) (Order, error)
 	InsertOrders(orders []Order) error
+	// UpdateOrder sets UpdatedAt to the current time unless the order already has one, and records the status change
 	UpdateOrder(order Order) error
+	// TransitionOrder atomically moves an order that is in one of the from statuses to the status of the change,
+	// records the change and returns the updated order. The change's At defaults to the current time.
+	TransitionOrder(id string, from []Status, change StatusChange) (Order, error)
+	CountByStatus() (map[Status]int, error)
+	GetOrdersByLastModifiedBy(actor string, page Page) ([]Order, error)
+	// SearchOrders returns a page of the orders matching every field of the search, oldest first
+	SearchOrders(search OrderSearch, page Page) ([]Order, error)
+	ArchiveCompletedOrders(olderThan time.Duration) (int, error)
+	// RecoverStuckOrders moves every Processing order that hasn't been updated for stuckFor to the status of
+	// the change in bulk, records the change and returns how many were moved. The change's At defaults to the
+	// current time.
+	RecoverStuckOrders(stuckFor time.Duration, change StatusChange) (int, error)
+	// Ping checks the database can be reached
+	Ping(ctx context.Context) error
+	// EnsureIndexes creates the indexes on indexedFields that don't exist yet
+	EnsureIndexes(ctx context.Context) error
 }
 
 type OrderService struct {
 	repo OrderRepo
+	// completedOrders receives orders once they are complete, if configured
+	completedOrders OrderPublisher
+	// orderQueue receives orders that are requeued
+	orderQueue OrderPublisher
+	// deadLetters holds orders the broker couldn't deliver, if it has a dead-letter queue
+	deadLetters DeadLetterQueue
+	// webhooks are notified when an update changes an order's status, if configured
+	webhooks *WebhookNotifier
 }
 
 func NewOrderService(repo OrderRepo) *OrderService {
-	return &OrderService{repo}
+	return &OrderService{repo: repo}
 }
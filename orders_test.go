@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestSortOrders(t *testing.T) {
+	created := time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)
+	orders := []Order{
+		{OrderID: "10", CreatedAt: created.Add(2 * time.Minute)},
+		{OrderID: "WEB-2", CreatedAt: created.Add(4 * time.Minute)},
+		{OrderID: "9", CreatedAt: created.Add(3 * time.Minute)},
+		{OrderID: "WEB-10", CreatedAt: created},
+		{OrderID: "100", CreatedAt: created.Add(time.Minute)},
+	}
+
+	tests := []struct {
+		spec string
+		want []string
+	}{
+		{spec: "", want: []string{"WEB-10", "100", "10", "9", "WEB-2"}},
+		{spec: "-createdAt", want: []string{"WEB-2", "9", "10", "100", "WEB-10"}},
+		{spec: "orderId", want: []string{"9", "10", "100", "WEB-10", "WEB-2"}},
+		{spec: "-orderId", want: []string{"WEB-2", "WEB-10", "100", "10", "9"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			sort, err := ParseOrderSort(tt.spec)
+			if err != nil {
+				t.Fatal(err)
+			}
+			sorted := slices.Clone(orders)
+			sortOrders(sorted, sort)
+
+			var got []string
+			for _, order := range sorted {
+				got = append(got, order.OrderID)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseOrderSortRejectsUnknownFields(t *testing.T) {
+	for _, spec := range []string{"total", "-", "-status"} {
+		if _, err := ParseOrderSort(spec); err == nil {
+			t.Errorf("ParseOrderSort(%q) succeeded, want an error", spec)
+		}
+	}
+}
+
+func TestStatusJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		json     string
+		want     Status
+		wantJSON string
+		wantErr  bool
+	}{
+		{name: "number", json: `2`, want: Complete, wantJSON: `"complete"`},
+		{name: "lower case name", json: `"complete"`, want: Complete, wantJSON: `"complete"`},
+		{name: "title case name", json: `"Complete"`, want: Complete, wantJSON: `"complete"`},
+		{name: "upper case name", json: `"COMPLETE"`, want: Complete, wantJSON: `"complete"`},
+		{name: "pending", json: `"pending"`, want: Pending, wantJSON: `"pending"`},
+		{name: "processing", json: `"Processing"`, want: Processing, wantJSON: `"processing"`},
+		{name: "cancelled", json: `"CANCELLED"`, want: Cancelled, wantJSON: `"cancelled"`},
+		{name: "pending completion", json: `"pendingcompletion"`, want: PendingCompletion, wantJSON: `"pendingCompletion"`},
+		{name: "completed alias", json: `"Completed"`, want: Complete, wantJSON: `"complete"`},
+		{name: "canceled alias", json: `"canceled"`, want: Cancelled, wantJSON: `"cancelled"`},
+		{name: "number without a name", json: `9`, want: Status(9), wantJSON: `9`},
+		{name: "unknown name", json: `"shipped"`, wantErr: true},
+		{name: "wrong type", json: `true`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var status Status
+			err := json.Unmarshal([]byte(tt.json), &status)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				var unknownErr *UnknownStatusError
+				if !errors.As(err, &unknownErr) {
+					t.Errorf("got error %v, want an UnknownStatusError", err)
+				}
+				return
+			}
+			if status != tt.want {
+				t.Errorf("got %s, want %s", status, tt.want)
+			}
+
+			data, err := json.Marshal(status)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.wantJSON {
+				t.Errorf("got JSON %s, want %s", data, tt.wantJSON)
+			}
+
+			// what is written reads back as the same status
+			var roundTrip Status
+			if err := json.Unmarshal(data, &roundTrip); err != nil || roundTrip != status {
+				t.Errorf("got %s with error %v reading back %s, want %s", roundTrip, err, data, status)
+			}
+		})
+	}
+}
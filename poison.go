@@ -0,0 +1,101 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	poisonMessages      = expvar.NewInt("poison_messages_total")
+	poisonMessageAlerts = expvar.NewInt("poison_message_alerts_total")
+)
+
+// Tracks failures of queue messages that can't be processed
+var poisonTracker = NewPoisonTracker(10, 5*time.Minute, nil)
+
+type poisonMessage struct {
+	failures int
+	lastSeen time.Time
+}
+
+// PoisonTracker counts queue messages that fail to process and raises an alert when
+// more than threshold of them fail within the window
+type PoisonTracker struct {
+	mu        sync.Mutex
+	threshold int
+	window    time.Duration
+	clock     Clock
+	failures  []time.Time
+	messages  map[string]*poisonMessage
+	alerted   bool
+}
+
+func NewPoisonTracker(threshold int, window time.Duration, clock Clock) *PoisonTracker {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &PoisonTracker{
+		threshold: threshold,
+		window:    window,
+		clock:     clock,
+		messages:  make(map[string]*poisonMessage),
+	}
+}
+
+// RecordFailure records that a message failed and reports whether the failure rate is over the threshold
+func (t *PoisonTracker) RecordFailure(body []byte, cause error) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.clock.Now()
+	t.expire(now)
+
+	// the same content failing repeatedly is a redelivered poison message
+	sum := sha256.Sum256(body)
+	key := hex.EncodeToString(sum[:])
+	message, ok := t.messages[key]
+	if !ok {
+		message = &poisonMessage{}
+		t.messages[key] = message
+	}
+	message.failures++
+	message.lastSeen = now
+	t.failures = append(t.failures, now)
+	poisonMessages.Add(1)
+
+	log.Printf("message %s failed %d times: %s", key[:12], message.failures, cause)
+
+	if len(t.failures) <= t.threshold {
+		t.alerted = false
+		return false
+	}
+
+	// only alert once each time the threshold is crossed
+	if !t.alerted {
+		t.alerted = true
+		poisonMessageAlerts.Add(1)
+		log.Printf("ALERT: %d messages failed to process in the last %s, exceeding the threshold of %d; check the order producers", len(t.failures), t.window, t.threshold)
+	}
+	return true
+}
+
+// Forgets failures that happened before the window
+func (t *PoisonTracker) expire(now time.Time) {
+	cutoff := now.Add(-t.window)
+
+	i := 0
+	for i < len(t.failures) && !t.failures[i].After(cutoff) {
+		i++
+	}
+	t.failures = t.failures[i:]
+
+	for key, message := range t.messages {
+		if !message.lastSeen.After(cutoff) {
+			delete(t.messages, key)
+		}
+	}
+}
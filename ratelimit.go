@@ -0,0 +1,121 @@
+package main
+
+import (
+	"crypto/subtle"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Maximum number of buckets kept before idle ones are pruned
+const maxRateLimitBuckets = 10000
+
+// Clock abstracts the current time so the rate limiter can be driven by a fake clock
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a token-bucket rate limiter keyed by caller
+type RateLimiter struct {
+	mu      sync.Mutex
+	rate    float64
+	burst   float64
+	clock   Clock
+	buckets map[string]*tokenBucket
+}
+
+func NewRateLimiter(rps float64, burst int, clock Clock) *RateLimiter {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &RateLimiter{
+		rate:    rps,
+		burst:   float64(burst),
+		clock:   clock,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// Allow takes a token from the bucket for key, returning how long to wait when none is available
+func (l *RateLimiter) Allow(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.clock.Now()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= maxRateLimitBuckets {
+			l.prune(now)
+		}
+		bucket = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	// Refill the bucket for the time elapsed since it was last used
+	elapsed := now.Sub(bucket.last).Seconds()
+	if elapsed > 0 {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+elapsed*l.rate)
+		bucket.last = now
+	}
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// Removes buckets that have refilled completely, since they behave the same as a new bucket
+func (l *RateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// RateLimitMiddleware rejects requests with 429 once the caller's bucket is empty. Callers are limited by
+// client IP, unless they send one of the known API keys, which gets a bucket of its own. Other API keys
+// are ignored, otherwise a client could send a new key with each request to avoid the limit.
+func RateLimitMiddleware(limiter *RateLimiter, apiKeys ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := "ip:" + c.ClientIP()
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			for i, known := range apiKeys {
+				if known != "" && subtle.ConstantTimeCompare([]byte(apiKey), []byte(known)) == 1 {
+					key = "key:" + strconv.Itoa(i)
+					break
+				}
+			}
+		}
+
+		allowed, wait := limiter.Allow(key)
+		if !allowed {
+			retryAfter := int(math.Ceil(wait.Seconds()))
+			log.Printf("Rate limit exceeded for %s, retry after %ds", c.ClientIP(), retryAfter)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.AbortWithStatus(http.StatusTooManyRequests)
+			return
+		}
+		c.Next()
+	}
+}
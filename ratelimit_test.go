@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// fakeClock is a Clock that only moves when advanced
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		key     string
+		allowed bool
+		wait    time.Duration
+	}
+
+	tests := []struct {
+		name  string
+		rps   float64
+		burst int
+		steps []step
+	}{
+		{
+			name:  "burst then wait for refill",
+			rps:   1,
+			burst: 2,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+				{advance: 500 * time.Millisecond, key: "a", allowed: false, wait: 500 * time.Millisecond},
+				{advance: 500 * time.Millisecond, key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+			},
+		},
+		{
+			name:  "refill is capped at the burst",
+			rps:   10,
+			burst: 1,
+			steps: []step{
+				{key: "a", allowed: true},
+				{advance: time.Hour, key: "a", allowed: true},
+				{key: "a", allowed: false, wait: 100 * time.Millisecond},
+			},
+		},
+		{
+			name:  "keys have separate buckets",
+			rps:   1,
+			burst: 1,
+			steps: []step{
+				{key: "a", allowed: true},
+				{key: "a", allowed: false, wait: time.Second},
+				{key: "b", allowed: true},
+				{key: "b", allowed: false, wait: time.Second},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := NewRateLimiter(tt.rps, tt.burst, clock)
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				allowed, wait := limiter.Allow(s.key)
+				if allowed != s.allowed || wait != s.wait {
+					t.Errorf("step %d: Allow(%q) = %v, %s, want %v, %s", i, s.key, allowed, wait, s.allowed, s.wait)
+				}
+			}
+		})
+	}
+}
+
+func TestRateLimiterPrunesFullBuckets(t *testing.T) {
+	clock := newFakeClock()
+	limiter := NewRateLimiter(1, 1, clock)
+	for i := 0; i < maxRateLimitBuckets; i++ {
+		limiter.Allow(strconv.Itoa(i))
+	}
+
+	// every bucket has refilled, so they are all pruned when the next key needs one
+	clock.Advance(time.Second)
+	limiter.Allow("new")
+	if len(limiter.buckets) != 1 {
+		t.Errorf("got %d buckets after pruning, want 1", len(limiter.buckets))
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		requests []map[string]string
+		want     []int
+	}{
+		{
+			name:     "limited by client IP",
+			requests: []map[string]string{{}, {}},
+			want:     []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "unknown API keys share the IP's bucket",
+			requests: []map[string]string{{"X-API-Key": "random-1"}, {"X-API-Key": "random-2"}},
+			want:     []int{http.StatusOK, http.StatusTooManyRequests},
+		},
+		{
+			name:     "known API key has its own bucket",
+			requests: []map[string]string{{}, {"X-API-Key": "admin"}, {"X-API-Key": "admin"}},
+			want:     []int{http.StatusOK, http.StatusOK, http.StatusTooManyRequests},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			router := gin.New()
+			router.Use(RateLimitMiddleware(NewRateLimiter(1, 1, newFakeClock()), "admin"))
+			router.POST("/", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+			for i, headers := range tt.requests {
+				req := httptest.NewRequest(http.MethodPost, "/", nil)
+				for name, value := range headers {
+					req.Header.Set(name, value)
+				}
+				w := httptest.NewRecorder()
+				router.ServeHTTP(w, req)
+
+				if w.Code != tt.want[i] {
+					t.Errorf("request %d: got status %d, want %d", i, w.Code, tt.want[i])
+				}
+				if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+					t.Errorf("request %d: got Retry-After %q, want 1", i, w.Header().Get("Retry-After"))
+				}
+			}
+		})
+	}
+}
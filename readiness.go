@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// QueueReadiness tracks whether the order queue can be reached. The service isn't ready until the queue
+// has been reached once, and stops being ready if it then can't be reached for longer than the threshold.
+// An instance on standby doesn't reach the queue, so it is ready regardless.
+type QueueReadiness struct {
+	mu           sync.Mutex
+	threshold    time.Duration
+	clock        Clock
+	connected    bool
+	failingSince time.Time
+	standby      bool
+}
+
+func NewQueueReadiness(threshold time.Duration, clock Clock) *QueueReadiness {
+	if clock == nil {
+		clock = realClock{}
+	}
+	return &QueueReadiness{threshold: threshold, clock: clock}
+}
+
+// RecordSuccess records that the queue was reached, even if it had no messages
+func (r *QueueReadiness) RecordSuccess() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.connected {
+		log.Printf("Connected to the order queue")
+	} else if !r.failingSince.IsZero() {
+		log.Printf("Reconnected to the order queue")
+	}
+	r.connected = true
+	r.failingSince = time.Time{}
+	r.standby = false
+}
+
+// RecordFailure records that the queue couldn't be reached
+func (r *QueueReadiness) RecordFailure() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.connected && r.failingSince.IsZero() {
+		r.failingSince = r.clock.Now()
+	}
+	r.standby = false
+}
+
+// RecordStandby records that another instance is draining the queue, so this one isn't reaching it. The
+// queue has to be reached again before the instance is ready once it stops being on standby.
+func (r *QueueReadiness) RecordStandby() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.standby = true
+	r.connected = false
+	r.failingSince = time.Time{}
+}
+
+// Ready reports whether the queue has been reached and hasn't been failing for longer than the threshold,
+// and if not, why
+func (r *QueueReadiness) Ready() (bool, string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.standby {
+		return true, ""
+	}
+	if !r.connected {
+		return false, "order queue has not been reached yet"
+	}
+	if !r.failingSince.IsZero() && r.clock.Now().Sub(r.failingSince) > r.threshold {
+		return false, "order queue has not been reachable since " + r.failingSince.UTC().Format(time.RFC3339)
+	}
+	return true, ""
+}
+
+// Reports whether the service can serve traffic. The database must respond and, if the queue is
+// tracked, the queue must be reachable.
+func getReadiness(queue *QueueReadiness) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		client, ok := c.MustGet("orderService").(*OrderService)
+		if !ok {
+			log.Printf("Failed to get order service")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+		err := client.repo.Ping(ctx)
+		cancel()
+		if err != nil {
+			log.Printf("Not ready, database is unhealthy: %s", err)
+			respond(c, http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": "database is unhealthy"})
+			return
+		}
+
+		if queue != nil {
+			if ready, reason := queue.Ready(); !ready {
+				respond(c, http.StatusServiceUnavailable, gin.H{"status": "not ready", "reason": reason})
+				return
+			}
+		}
+
+		respond(c, http.StatusOK, gin.H{"status": "ready"})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestQueueReadiness(t *testing.T) {
+	type step struct {
+		advance time.Duration
+		// record is "success", "failure", "standby" or empty to only check readiness
+		record    string
+		wantReady bool
+	}
+
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{
+			name: "not ready until the queue is reached",
+			steps: []step{
+				{wantReady: false},
+				{record: "failure", wantReady: false},
+				{advance: time.Hour, wantReady: false},
+				{record: "success", wantReady: true},
+			},
+		},
+		{
+			name: "stays ready through failures shorter than the threshold",
+			steps: []step{
+				{record: "success", wantReady: true},
+				{record: "failure", wantReady: true},
+				{advance: 30 * time.Second, record: "failure", wantReady: true},
+				{advance: 30 * time.Second, wantReady: true},
+			},
+		},
+		{
+			name: "stops being ready once failing longer than the threshold",
+			steps: []step{
+				{record: "success", wantReady: true},
+				{record: "failure", wantReady: true},
+				{advance: 61 * time.Second, wantReady: false},
+				{record: "success", wantReady: true},
+			},
+		},
+		{
+			name: "a success resets how long the queue has been failing",
+			steps: []step{
+				{record: "success", wantReady: true},
+				{record: "failure", wantReady: true},
+				{advance: 50 * time.Second, record: "success", wantReady: true},
+				{record: "failure", wantReady: true},
+				{advance: 50 * time.Second, wantReady: true},
+			},
+		},
+		{
+			name: "ready on standby",
+			steps: []step{
+				{record: "standby", wantReady: true},
+				{advance: time.Hour, wantReady: true},
+			},
+		},
+		{
+			name: "has to reach the queue again after standby",
+			steps: []step{
+				{record: "success", wantReady: true},
+				{record: "standby", wantReady: true},
+				{record: "failure", wantReady: false},
+				{record: "success", wantReady: true},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			clock := newFakeClock()
+			readiness := NewQueueReadiness(time.Minute, clock)
+
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				switch s.record {
+				case "success":
+					readiness.RecordSuccess()
+				case "failure":
+					readiness.RecordFailure()
+				case "standby":
+					readiness.RecordStandby()
+				}
+
+				ready, reason := readiness.Ready()
+				if ready != s.wantReady {
+					t.Errorf("step %d: got ready %v (%q), want %v", i, ready, reason, s.wantReady)
+				}
+				if !ready && reason == "" {
+					t.Errorf("step %d: not ready without a reason", i)
+				}
+			}
+		})
+	}
+}
+
+func TestGetReadiness(t *testing.T) {
+	tests := []struct {
+		name         string
+		pingErr      error
+		queueReached bool
+		// untracked serves readiness without tracking the queue
+		untracked bool
+		wantCode  int
+	}{
+		{name: "ready", queueReached: true, wantCode: http.StatusOK},
+		{name: "database unhealthy", pingErr: errors.New("database down"), queueReached: true, wantCode: http.StatusServiceUnavailable},
+		{name: "queue not reached yet", wantCode: http.StatusServiceUnavailable},
+		{name: "queue not tracked", untracked: true, wantCode: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo := &consumerTestRepo{InMemoryOrderRepo: NewInMemoryOrderRepo(), pingErr: tt.pingErr}
+
+			var readiness *QueueReadiness
+			if !tt.untracked {
+				readiness = NewQueueReadiness(time.Minute, newFakeClock())
+				if tt.queueReached {
+					readiness.RecordSuccess()
+				}
+			}
+
+			gin.SetMode(gin.TestMode)
+			router := gin.New()
+			router.Use(OrderMiddleware(NewOrderService(repo)))
+			router.GET("/health/ready", getReadiness(readiness))
+
+			w := serveJSON(router, http.MethodGet, "/health/ready", nil)
+			if w.Code != tt.wantCode {
+				t.Errorf("got status %d, want %d", w.Code, tt.wantCode)
+			}
+		})
+	}
+}
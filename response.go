@@ -0,0 +1,86 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Pretty-print every JSON response, otherwise responses are compact unless a request asks for ?pretty=true
+var responsePretty bool
+
+// MIME type of order lists written as CSV
+const mimeCSV = "text/csv"
+
+// Number of CSV rows written between flushes, so large order lists reach the client as they are written
+const csvFlushRows = 100
+
+// Writes a JSON response, indented if pretty-printing is enabled or the request overrides it with the pretty query parameter
+func respond(c *gin.Context, status int, obj any) {
+	pretty := responsePretty
+	if value := c.Query("pretty"); value != "" {
+		pretty = value == "true"
+	}
+
+	if pretty {
+		c.IndentedJSON(status, obj)
+		return
+	}
+	c.JSON(status, obj)
+}
+
+// Picks the format of an order list from the Accept header, JSON unless CSV is asked for. It aborts the
+// request with a 406 and returns false if neither is acceptable.
+func negotiateOrdersFormat(c *gin.Context) (string, bool) {
+	c.Header("Vary", "Accept")
+	format := c.NegotiateFormat(gin.MIMEJSON, mimeCSV)
+	if format == "" {
+		abortWithError(c, http.StatusNotAcceptable, "not_acceptable", fmt.Sprintf("orders can only be returned as %s or %s", gin.MIMEJSON, mimeCSV))
+		return "", false
+	}
+	return format, true
+}
+
+// Writes an order list in the negotiated format
+func respondOrders(c *gin.Context, format string, orders []Order) {
+	if format != mimeCSV {
+		respond(c, http.StatusOK, orders)
+		return
+	}
+
+	c.Header("Content-Type", mimeCSV+"; charset=utf-8")
+	c.Status(http.StatusOK)
+
+	// rows are written straight to the response instead of building the whole document first, the orders
+	// themselves are already in memory and bounded by the page or the pending orders
+	writer := csv.NewWriter(c.Writer)
+	if err := writer.Write([]string{"orderId", "status", "total", "createdAt"}); err != nil {
+		log.Printf("Failed to write CSV response: %s", err)
+		return
+	}
+	for i, order := range orders {
+		createdAt := ""
+		if !order.CreatedAt.IsZero() {
+			createdAt = order.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		// the status has already been sent, so a failed write leaves the client with a truncated document
+		if err := writer.Write([]string{order.OrderID, order.Status.String(), strconv.FormatFloat(order.Total, 'f', 2, 64), createdAt}); err != nil {
+			log.Printf("Failed to write CSV response: %s", err)
+			return
+		}
+
+		if (i+1)%csvFlushRows == 0 {
+			writer.Flush()
+			c.Writer.Flush()
+		}
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		log.Printf("Failed to write CSV response: %s", err)
+	}
+}
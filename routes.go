@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route is a set of handlers for a method and path
+type Route struct {
+	Method   string
+	Path     string
+	Handlers []gin.HandlerFunc
+}
+
+// Registers the routes, returning an error for duplicate or conflicting routes rather than
+// panicking or letting one route shadow another
+func registerRoutes(router gin.IRoutes, routes []Route) error {
+	registered := make(map[string]string)
+	for _, route := range routes {
+		// routes that only differ by parameter names match the same requests
+		key := route.Method + " " + routePattern(route.Path)
+		if existing, ok := registered[key]; ok {
+			return fmt.Errorf("route %s %s is already registered as %s %s", route.Method, route.Path, route.Method, existing)
+		}
+		registered[key] = route.Path
+
+		if err := handleRoute(router, route); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Registers a single route, converting the panic gin raises for conflicting routes into an error
+func handleRoute(router gin.IRoutes, route Route) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("route %s %s conflicts with an existing route: %v", route.Method, route.Path, r)
+		}
+	}()
+	router.Handle(route.Method, route.Path, route.Handlers...)
+	return nil
+}
+
+// Replaces parameter names in a path so equivalent paths compare equal
+func routePattern(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = ":"
+		} else if strings.HasPrefix(segment, "*") {
+			segments[i] = "*"
+		}
+	}
+	return strings.Join(segments, "/")
+}
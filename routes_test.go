@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	handler := func(c *gin.Context) { c.Status(http.StatusOK) }
+
+	tests := []struct {
+		name    string
+		routes  []Route
+		wantErr bool
+	}{
+		{
+			name: "distinct routes",
+			routes: []Route{
+				{http.MethodGet, "/order/:id", []gin.HandlerFunc{handler}},
+				{http.MethodPut, "/order", []gin.HandlerFunc{handler}},
+				{http.MethodPost, "/order/:id/confirm", []gin.HandlerFunc{handler}},
+			},
+		},
+		{
+			name: "same path with different methods",
+			routes: []Route{
+				{http.MethodGet, "/order", []gin.HandlerFunc{handler}},
+				{http.MethodPut, "/order", []gin.HandlerFunc{handler}},
+			},
+		},
+		{
+			name: "duplicate route",
+			routes: []Route{
+				{http.MethodGet, "/order/fetch", []gin.HandlerFunc{handler}},
+				{http.MethodGet, "/order/fetch", []gin.HandlerFunc{handler}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "same route with different parameter names",
+			routes: []Route{
+				{http.MethodGet, "/order/:id", []gin.HandlerFunc{handler}},
+				{http.MethodGet, "/order/:orderId", []gin.HandlerFunc{handler}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "wildcard conflicting with a parameter",
+			routes: []Route{
+				{http.MethodGet, "/order/:id", []gin.HandlerFunc{handler}},
+				{http.MethodGet, "/order/*path", []gin.HandlerFunc{handler}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gin.SetMode(gin.TestMode)
+			err := registerRoutes(gin.New(), tt.routes)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
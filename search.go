@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ErrEncryptedFieldSearch is returned when a search filters on a field that is encrypted at rest, which
+// can't be matched because each value is encrypted with a random nonce
+var ErrEncryptedFieldSearch = errors.New("encrypted fields can't be searched")
+
+// UnknownSearchFieldsError is returned when a search filters on fields that can't be searched
+type UnknownSearchFieldsError struct {
+	Fields []string
+}
+
+func (e *UnknownSearchFieldsError) Error() string {
+	return fmt.Sprintf("unknown search fields %s, orders can only be searched by %s", strings.Join(e.Fields, ", "), strings.Join(searchableFields, ", "))
+}
+
+// Order fields that can be searched, by their JSON name. Values are always passed to the database as
+// parameters, and only these fields are ever used in a query.
+var searchableFields = []string{"customerId", "status", "storeId", "lastModifiedBy", "createdAfter", "createdBefore"}
+
+// OrderSearch filters orders by their fields. Fields that are empty don't filter.
+type OrderSearch struct {
+	CustomerID     string  `json:"customerId"`
+	Status         *Status `json:"status"`
+	StoreID        string  `json:"storeId"`
+	LastModifiedBy string  `json:"lastModifiedBy"`
+	// CreatedAfter only includes orders created at or after this time, unless it is zero
+	CreatedAfter time.Time `json:"createdAfter"`
+	// CreatedBefore only includes orders created before this time, unless it is zero
+	CreatedBefore time.Time `json:"createdBefore"`
+}
+
+// Reports whether an order matches every field of the search
+func (s OrderSearch) matches(order Order) bool {
+	if s.CustomerID != "" && order.CustomerID != s.CustomerID {
+		return false
+	}
+	if s.Status != nil && order.Status != *s.Status {
+		return false
+	}
+	if s.StoreID != "" && order.StoreID != s.StoreID {
+		return false
+	}
+	if s.LastModifiedBy != "" && order.LastModifiedBy != s.LastModifiedBy {
+		return false
+	}
+	return PendingOrdersOptions{CreatedAfter: s.CreatedAfter, CreatedBefore: s.CreatedBefore}.inCreatedRange(order)
+}
+
+// Decodes a search from the request body, rejecting every field that isn't searchable
+func decodeOrderSearch(c *gin.Context) (OrderSearch, error) {
+	var fields map[string]json.RawMessage
+	if err := decodeJSONBody(c, &fields); err != nil {
+		var typeErr *json.UnmarshalTypeError
+		if errors.As(err, &typeErr) && typeErr.Field == "" {
+			return OrderSearch{}, errors.New("search must be a JSON object")
+		}
+		return OrderSearch{}, err
+	}
+
+	var unknown []string
+	for name := range fields {
+		if !slices.Contains(searchableFields, name) {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		slices.Sort(unknown)
+		return OrderSearch{}, &UnknownSearchFieldsError{Fields: unknown}
+	}
+
+	// the fields have been checked, so decode them again into the search
+	body, err := json.Marshal(fields)
+	if err != nil {
+		return OrderSearch{}, err
+	}
+	var search OrderSearch
+	if err := json.Unmarshal(body, &search); err != nil {
+		return OrderSearch{}, err
+	}
+	return search, nil
+}
+
+// Searches orders by their fields
+func searchOrders(c *gin.Context) {
+	client, ok := c.MustGet("orderService").(*OrderService)
+	if !ok {
+		log.Printf("Failed to get order service")
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	format, ok := negotiateOrdersFormat(c)
+	if !ok {
+		return
+	}
+
+	page, err := parsePage(c)
+	if err != nil {
+		abortWithError(c, http.StatusBadRequest, "invalid_parameter", err.Error())
+		return
+	}
+
+	search, err := decodeOrderSearch(c)
+	if err != nil {
+		log.Printf("Invalid order search: %s", err)
+		var unknownErr *UnknownSearchFieldsError
+		var parseErr *time.ParseError
+		switch {
+		case errors.As(err, &unknownErr):
+			abortWithError(c, http.StatusBadRequest, "unknown_field", err.Error())
+		case errors.As(err, &parseErr):
+			abortWithError(c, http.StatusBadRequest, "invalid_field", fmt.Sprintf("createdAfter and createdBefore must be RFC 3339 timestamps such as 2024-01-02T15:04:05Z, got %q", parseErr.Value))
+		default:
+			abortWithDecodeError(c, err)
+		}
+		return
+	}
+
+	if !search.CreatedAfter.IsZero() && !search.CreatedBefore.IsZero() && !search.CreatedAfter.Before(search.CreatedBefore) {
+		abortWithError(c, http.StatusBadRequest, "invalid_field", "createdAfter must be before createdBefore")
+		return
+	}
+
+	stopTiming := timePhase(c, "db")
+	orders, err := client.repo.SearchOrders(search, page)
+	stopTiming()
+	if err != nil {
+		if errors.Is(err, ErrEncryptedFieldSearch) {
+			abortWithError(c, http.StatusBadRequest, "invalid_field", err.Error())
+			return
+		}
+		log.Printf("Failed to search orders in database: %s", err)
+		c.AbortWithStatus(http.StatusInternalServerError)
+		return
+	}
+
+	for i := range orders {
+		orders[i].backfill()
+	}
+
+	respondOrders(c, format, orders)
+}
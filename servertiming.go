@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ServerTiming collects how long each phase of a request took
+type ServerTiming struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases []string
+	totals map[string]time.Duration
+}
+
+func NewServerTiming() *ServerTiming {
+	return &ServerTiming{start: time.Now(), totals: make(map[string]time.Duration)}
+}
+
+// Add adds to the time spent in a phase
+func (t *ServerTiming) Add(phase string, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if _, ok := t.totals[phase]; !ok {
+		t.phases = append(t.phases, phase)
+	}
+	t.totals[phase] += d
+}
+
+// Header renders the phases and the total request time as a Server-Timing header value
+func (t *ServerTiming) Header() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	metrics := make([]string, 0, len(t.phases)+1)
+	for _, phase := range t.phases {
+		metrics = append(metrics, formatServerTiming(phase, t.totals[phase]))
+	}
+	metrics = append(metrics, formatServerTiming("total", time.Since(t.start)))
+	return strings.Join(metrics, ", ")
+}
+
+func formatServerTiming(name string, d time.Duration) string {
+	return fmt.Sprintf("%s;dur=%.3f", name, float64(d.Microseconds())/1000)
+}
+
+// Starts timing a phase of the request and returns a function that stops it. A gin context looks the timing
+// up in its keys, so code shared with the gRPC API can be timed from any context.
+func timePhase(ctx context.Context, phase string) func() {
+	timing, ok := ctx.Value("serverTiming").(*ServerTiming)
+	if !ok {
+		return func() {}
+	}
+	start := time.Now()
+	return func() {
+		timing.Add(phase, time.Since(start))
+	}
+}
+
+// ServerTimingMiddleware adds a Server-Timing header breaking down where the request spent its time
+func ServerTimingMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		timing := NewServerTiming()
+		c.Set("serverTiming", timing)
+		c.Writer = &serverTimingWriter{ResponseWriter: c.Writer, timing: timing}
+		c.Next()
+	}
+}
+
+// serverTimingWriter sets the Server-Timing header just before the response is written. Gin
+// sets the status before rendering the body, so the time until the body is written is the
+// time spent serializing it.
+type serverTimingWriter struct {
+	gin.ResponseWriter
+	timing      *ServerTiming
+	renderStart time.Time
+	written     bool
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	if w.renderStart.IsZero() {
+		w.renderStart = time.Now()
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) WriteHeaderNow() {
+	w.setHeader(false)
+	w.ResponseWriter.WriteHeaderNow()
+}
+
+func (w *serverTimingWriter) Write(data []byte) (int, error) {
+	w.setHeader(true)
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *serverTimingWriter) WriteString(s string) (int, error) {
+	w.setHeader(true)
+	return w.ResponseWriter.WriteString(s)
+}
+
+func (w *serverTimingWriter) setHeader(hasBody bool) {
+	if w.written || w.ResponseWriter.Written() {
+		return
+	}
+	w.written = true
+	if hasBody && !w.renderStart.IsZero() {
+		w.timing.Add("serialization", time.Since(w.renderStart))
+	}
+	w.Header().Set("Server-Timing", w.timing.Header())
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+// ErrExternalRefConflict is returned when completing an order that was completed with a different external reference
+var ErrExternalRefConflict = errors.New("order was already completed with a different external reference")
+
+// OrderUpdate is the outcome of an update
+type OrderUpdate struct {
+	// Status is the status the order moved to, which is PendingCompletion if completing it needs to be confirmed
+	Status Status
+	// Unchanged is set when the order was already complete with the same external reference
+	Unchanged bool
+}
+
+// UpdateOrder validates an update of an order's status and applies it. It is shared by the REST and gRPC
+// APIs so both update orders the same way. Transitions are only checked while confirmation is enabled or
+// when completing with an external reference, which is idempotent for the same reference and conflicts
+// with any other. Webhooks are told when the status changes, and completed orders are published.
+func (s *OrderService) UpdateOrder(ctx context.Context, order Order) (OrderUpdate, error) {
+	// Validate the whole order, allowing specific statuses for updates, and sanitize the order ID
+	fieldErrors := validateOrder(order, Processing, Complete)
+	if order.OrderID != "" {
+		sanitizedOrderId, err := sanitizeOrderID(order.OrderID)
+		if err != nil {
+			fieldErrors = append(fieldErrors, FieldError{Field: "orderId", Message: err.Error()})
+		}
+		order.OrderID = sanitizedOrderId
+	}
+	if len(fieldErrors) > 0 {
+		return OrderUpdate{}, &ValidationError{fieldErrors}
+	}
+
+	// Record who made the change and when so it can be audited
+	order.LastModifiedBy = actorOrAnonymous(order.LastModifiedBy)
+	order.UpdatedAt = time.Now().UTC()
+
+	// The existing order is needed to complete idempotently, to check for confirmation and to tell webhooks
+	// whether the status changed
+	checkTransition := (order.Status == Complete && order.ExternalRef != "") || confirmationThreshold > 0
+	var existingOrder Order
+	if checkTransition || s.webhooks != nil {
+		var err error
+		existingOrder, err = getOrderForUpdateTimed(ctx, s.repo, order.OrderID)
+		if err != nil {
+			return OrderUpdate{}, err
+		}
+	}
+
+	if checkTransition {
+		// Completing with an external reference is idempotent for the same reference
+		if order.Status == Complete && order.ExternalRef != "" && existingOrder.Status == Complete {
+			if existingOrder.ExternalRef != order.ExternalRef {
+				return OrderUpdate{}, ErrExternalRefConflict
+			}
+			return OrderUpdate{Status: Complete, Unchanged: true}, nil
+		}
+
+		if err := applyTransition(existingOrder, &order); err != nil {
+			return OrderUpdate{}, err
+		}
+	}
+
+	// Completing with an external reference only succeeds if the order isn't complete yet, so of two
+	// concurrent completions with different references only one wins
+	var err error
+	stopTiming := timePhase(ctx, "db")
+	if order.Status == Complete && order.ExternalRef != "" {
+		_, err = s.repo.TransitionOrder(order.OrderID, completionSources(), StatusChange{Status: Complete, At: order.UpdatedAt, Actor: order.LastModifiedBy, ExternalRef: order.ExternalRef})
+	} else {
+		err = s.repo.UpdateOrder(order)
+	}
+	stopTiming()
+	if errors.Is(err, ErrPreconditionFailed) {
+		completedOrder, getErr := getOrderForUpdateTimed(ctx, s.repo, order.OrderID)
+		if getErr == nil && completedOrder.Status == Complete {
+			if completedOrder.ExternalRef != order.ExternalRef {
+				return OrderUpdate{}, ErrExternalRefConflict
+			}
+			return OrderUpdate{Status: Complete, Unchanged: true}, nil
+		}
+		return OrderUpdate{}, err
+	}
+	if err != nil {
+		return OrderUpdate{}, err
+	}
+
+	log.Printf("Order %s updated successfully", order.OrderID)
+
+	if s.webhooks != nil && order.Status != existingOrder.Status {
+		notifyStatusChange(s, order.OrderID)
+	}
+
+	if order.Status == Complete && s.completedOrders != nil {
+		stopTiming = timePhase(ctx, "queue")
+		publishCompletedOrder(s, order.OrderID)
+		stopTiming()
+	}
+
+	return OrderUpdate{Status: order.Status}, nil
+}
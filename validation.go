@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// FieldError describes a problem with one field of an order
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// ValidationError is returned when an order has problems with any of its fields
+type ValidationError struct {
+	Errors []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	problems := make([]string, len(e.Errors))
+	for i, fieldErr := range e.Errors {
+		problems[i] = fieldErr.Field + " " + fieldErr.Message
+	}
+	return "invalid order: " + strings.Join(problems, ", ")
+}
+
+// Checks every field of an order and returns all of the problems found, so they can be reported together.
+// The order's status must be one of statuses.
+func validateOrder(order Order, statuses ...Status) []FieldError {
+	var fieldErrors []FieldError
+
+	if order.OrderID == "" {
+		fieldErrors = append(fieldErrors, FieldError{Field: "orderId", Message: "required"})
+	}
+
+	if !slices.Contains(statuses, order.Status) {
+		names := make([]string, len(statuses))
+		for i, status := range statuses {
+			names[i] = status.String()
+		}
+		fieldErrors = append(fieldErrors, FieldError{Field: "status", Message: fmt.Sprintf("must be one of %s, got %s", strings.Join(names, ", "), order.Status)})
+	}
+
+	for i, item := range order.Items {
+		if item.Quantity <= 0 {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("items[%d].quantity", i), Message: "must be greater than 0"})
+		}
+		if item.Price < 0 {
+			fieldErrors = append(fieldErrors, FieldError{Field: fmt.Sprintf("items[%d].price", i), Message: "must not be negative"})
+		}
+	}
+
+	return fieldErrors
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+)
+
+// Header carrying the HMAC-SHA256 signature of a webhook body, computed with the shared secret
+const webhookSignatureHeader = "X-Webhook-Signature"
+
+// Header carrying an ID that stays the same across retries of a delivery, so receivers can ignore duplicates
+const webhookDeliveryHeader = "X-Webhook-Delivery"
+
+// Longest wait between retries of a webhook delivery
+const webhookMaxRetryDelay = 30 * time.Second
+
+// WebhookNotifier POSTs orders to a set of URLs in the background. Each delivery is retried with a doubling
+// delay while the receiver can't be reached or responds with a server error.
+type WebhookNotifier struct {
+	urls        []*url.URL
+	secret      []byte
+	client      *http.Client
+	maxAttempts int
+	retryDelay  time.Duration
+}
+
+// NewWebhookNotifier parses the comma-separated webhook URLs. Each attempt to deliver to a URL gives up
+// after the timeout.
+func NewWebhookNotifier(urls string, secret string, timeout time.Duration, maxAttempts int, retryDelay time.Duration) (*WebhookNotifier, error) {
+	if secret == "" {
+		return nil, fmt.Errorf("a webhook secret is required to sign deliveries")
+	}
+	if maxAttempts < 1 {
+		return nil, fmt.Errorf("webhook deliveries must be attempted at least once")
+	}
+
+	n := &WebhookNotifier{
+		secret:      []byte(secret),
+		client:      &http.Client{Timeout: timeout},
+		maxAttempts: maxAttempts,
+		retryDelay:  retryDelay,
+	}
+	for _, rawURL := range strings.Split(urls, ",") {
+		rawURL = strings.TrimSpace(rawURL)
+		if rawURL == "" {
+			continue
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("webhook URL %q must be an absolute http or https URL", rawURL)
+		}
+		n.urls = append(n.urls, u)
+	}
+	if len(n.urls) == 0 {
+		return nil, fmt.Errorf("no webhook URLs are configured")
+	}
+	return n, nil
+}
+
+// Signs a webhook body the way receivers verify it, as sha256= followed by the hex encoded HMAC-SHA256
+// of the body
+func signWebhookBody(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Notify sends the order to every webhook without waiting for the deliveries
+func (n *WebhookNotifier) Notify(order Order) {
+	body, err := json.Marshal(order)
+	if err != nil {
+		log.Printf("Failed to marshal order %s for webhooks: %s", order.OrderID, err)
+		webhookDeliveryFailures.Add(int64(len(n.urls)))
+		return
+	}
+
+	deliveryID := uuid.Must(uuid.NewV4()).String()
+	for _, u := range n.urls {
+		go n.deliver(u, deliveryID, body)
+	}
+}
+
+// Delivers a body to a webhook, retrying until it succeeds or the attempts run out
+func (n *WebhookNotifier) deliver(u *url.URL, deliveryID string, body []byte) error {
+	backoff := NewBackoff(n.retryDelay, webhookMaxRetryDelay)
+
+	var err error
+	for attempt := 1; attempt <= n.maxAttempts; attempt++ {
+		if attempt > 1 {
+			time.Sleep(backoff.Next())
+		}
+
+		var retry bool
+		retry, err = n.post(u, deliveryID, body)
+		if err == nil {
+			log.Printf("Delivered webhook %s to %s", deliveryID, u.Host)
+			webhookDeliveries.Add(1)
+			return nil
+		}
+		log.Printf("Failed to deliver webhook %s to %s on attempt %d of %d: %s", deliveryID, u.Host, attempt, n.maxAttempts, err)
+		if !retry {
+			break
+		}
+	}
+
+	webhookDeliveryFailures.Add(1)
+	return err
+}
+
+// Makes one attempt to deliver a body, reporting whether a failure is worth retrying
+func (n *WebhookNotifier) post(u *url.URL, deliveryID string, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookDeliveryHeader, deliveryID)
+	req.Header.Set(webhookSignatureHeader, signWebhookBody(n.secret, body))
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		// the error includes the full URL, which may carry credentials
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	// drain the body so the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	// other client errors won't succeed by sending the same body again
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+	return retry, fmt.Errorf("webhook responded with %s", resp.Status)
+}
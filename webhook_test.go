@@ -0,0 +1,122 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSignWebhookBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		secret string
+		body   string
+		want   string
+	}{
+		{name: "order", secret: "secret", body: `{"orderId":"1"}`, want: "sha256=51e19c78d07c410ab9e154daa7044dc145f857a1b26b5126da3df8e3a8fa61d9"},
+		{name: "other secret", secret: "other", body: `{"orderId":"1"}`, want: "sha256=75047722cd5c6467149710848934b1adaf967f9926f8f8993be7693143334a9e"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := signWebhookBody([]byte(tt.secret), []byte(tt.body)); got != tt.want {
+				t.Errorf("got signature %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewWebhookNotifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		urls        string
+		secret      string
+		maxAttempts int
+		wantURLs    int
+		wantErr     bool
+	}{
+		{name: "several URLs", urls: "https://a.example.com/hook, http://b.example.com/hook,", secret: "secret", maxAttempts: 3, wantURLs: 2},
+		{name: "no secret", urls: "https://a.example.com/hook", maxAttempts: 3, wantErr: true},
+		{name: "no attempts", urls: "https://a.example.com/hook", secret: "secret", wantErr: true},
+		{name: "relative URL", urls: "/hook", secret: "secret", maxAttempts: 3, wantErr: true},
+		{name: "other scheme", urls: "ftp://a.example.com/hook", secret: "secret", maxAttempts: 3, wantErr: true},
+		{name: "no URLs", urls: " , ", secret: "secret", maxAttempts: 3, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			notifier, err := NewWebhookNotifier(tt.urls, tt.secret, time.Second, tt.maxAttempts, time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && len(notifier.urls) != tt.wantURLs {
+				t.Errorf("got %d URLs, want %d", len(notifier.urls), tt.wantURLs)
+			}
+		})
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	tests := []struct {
+		name        string
+		maxAttempts int
+		// responses are the statuses returned by each attempt, the last is repeated
+		responses    []int
+		wantAttempts int
+		wantErr      bool
+	}{
+		{name: "delivered first time", maxAttempts: 3, responses: []int{http.StatusNoContent}, wantAttempts: 1},
+		{name: "retries a server error", maxAttempts: 3, responses: []int{http.StatusInternalServerError, http.StatusOK}, wantAttempts: 2},
+		{name: "retries when rate limited", maxAttempts: 3, responses: []int{http.StatusTooManyRequests, http.StatusOK}, wantAttempts: 2},
+		{name: "retries a timeout", maxAttempts: 3, responses: []int{http.StatusRequestTimeout, http.StatusOK}, wantAttempts: 2},
+		{name: "gives up after the attempts run out", maxAttempts: 3, responses: []int{http.StatusBadGateway}, wantAttempts: 3, wantErr: true},
+		{name: "doesn't retry a client error", maxAttempts: 3, responses: []int{http.StatusBadRequest}, wantAttempts: 1, wantErr: true},
+		{name: "doesn't retry a missing endpoint", maxAttempts: 3, responses: []int{http.StatusNotFound}, wantAttempts: 1, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var signatures, deliveryIDs []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				body, _ := io.ReadAll(r.Body)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if got, want := r.Header.Get(webhookSignatureHeader), signWebhookBody([]byte("secret"), body); got != want {
+					t.Errorf("got signature %s, want %s", got, want)
+				}
+				signatures = append(signatures, r.Header.Get(webhookSignatureHeader))
+				deliveryIDs = append(deliveryIDs, r.Header.Get(webhookDeliveryHeader))
+				w.WriteHeader(tt.responses[min(len(signatures), len(tt.responses))-1])
+			}))
+			defer server.Close()
+
+			notifier, err := NewWebhookNotifier(server.URL, "secret", time.Second, tt.maxAttempts, time.Millisecond)
+			if err != nil {
+				t.Fatal(err)
+			}
+			u, _ := url.Parse(server.URL)
+
+			err = notifier.deliver(u, "delivery-1", []byte(`{"orderId":"1"}`))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, want error %v", err, tt.wantErr)
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			if len(signatures) != tt.wantAttempts {
+				t.Errorf("got %d attempts, want %d", len(signatures), tt.wantAttempts)
+			}
+			// retries resend the same delivery so receivers can ignore duplicates
+			if slices.ContainsFunc(deliveryIDs, func(id string) bool { return id != "delivery-1" }) {
+				t.Errorf("got delivery IDs %v, want delivery-1 for every attempt", deliveryIDs)
+			}
+		})
+	}
+}